@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// a snapshot carries every user, so it gets far more room than one user's body
+const maxSnapshotBytes = 256 << 20
+
+// downloads everything in the store, in the format POST /admin/restore takes
+func (s *Server) getSnapshot(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	store, ok := s.store(r.Context()).(Snapshotter)
+	if !ok {
+		writeJSONError(
+			w,
+			http.StatusNotImplemented,
+			"the store doesn't support snapshots",
+		)
+		return
+	}
+
+	span := storeSpan(r.Context(), "Snapshot")
+	snap, err := store.Snapshot()
+	span.End()
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="users-snapshot.json"`)
+	writeJSON(w, r, http.StatusOK, snap)
+}
+
+// replaces everything in the store with a snapshot from GET /admin/snapshot
+// nothing changes unless the whole snapshot is valid
+func (s *Server) restoreSnapshot(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	store, ok := s.store(r.Context()).(Snapshotter)
+	if !ok {
+		writeJSONError(
+			w,
+			http.StatusNotImplemented,
+			"the store doesn't support snapshots",
+		)
+		return
+	}
+
+	var snap Snapshot
+	if !decodeBodyMax(w, r, &snap, maxSnapshotBytes) {
+		return
+	}
+
+	// the same rules as creating a user, except that users from before
+	// emails existed may have none
+	errs := map[string]string{}
+	for i := range snap.Users {
+		user := &snap.Users[i]
+		var err error
+		if user.Email == "" {
+			err = s.validateUser(user, "Name")
+		} else {
+			err = s.validateUser(user)
+		}
+		if err != nil {
+			errs[strconv.Itoa(i)] = err.Error()
+		}
+	}
+	if len(errs) > 0 {
+		writeJSONErrors(
+			w,
+			http.StatusBadRequest,
+			"snapshot contains invalid users",
+			errs,
+		)
+		return
+	}
+	// ids and uniqueness across the whole snapshot
+	if err := snap.check(); err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// the request timed out and the client already got a 503,
+	// don't make a change it will never hear about
+	if r.Context().Err() != nil {
+		return
+	}
+
+	span := storeSpan(r.Context(), "LoadSnapshot")
+	err := store.LoadSnapshot(snap)
+	span.End()
+	// names check let through but the store, ignoring case, doesn't
+	if errors.Is(err, ErrNameTaken) {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+	if errors.Is(err, ErrStoreFull) {
+		writeError(
+			w,
+			http.StatusInsufficientStorage,
+			err,
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r, userEvent{Type: eventSnapshotLoaded})
+
+	writeJSON(w, r, http.StatusOK, map[string]int{"restored": len(snap.Users)})
+}
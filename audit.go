@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how many entries may wait for the writer before record has to wait too
+const auditBufferSize = 1024
+
+// how many entries the log keeps when Server.AuditSize isn't set
+const defaultAuditSize = 10000
+
+// one change made through the API, as GET /audit returns it
+type auditEntry struct {
+	// position in the log starting at 1, entries are never reordered and
+	// keep their number when older ones are dropped
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	// the event type of the change, e.g. "created" or "deleted_all"
+	Action string `json:"action"`
+	// missing for changes to every user at once
+	UserID     int    `json:"user_id,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	// who the change was made as, see userFromContext. missing without auth
+	Actor string `json:"actor,omitempty"`
+	// whose user was changed, missing for the shared tenant
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// the latest changes made through the API, oldest first. once it holds
+// size entries every new one replaces the oldest, so memory stays bounded
+// the zero value is ready to use, keeping defaultAuditSize entries
+type auditLog struct {
+	// set before the first record, defaultAuditSize when zero
+	size int
+
+	// handlers hand entries to a single writer, so they never wait on
+	// GET /audit readers holding mu
+	startOnce sync.Once
+	queue     chan auditEntry
+
+	mu sync.RWMutex
+	// a ring once it's full, the oldest entry at start
+	entries []auditEntry
+	start   int
+	// the Seq of the latest entry
+	seq int
+}
+
+// queues entry for the log, it shows up in page a moment later
+func (a *auditLog) record(entry auditEntry) {
+	a.startOnce.Do(func() {
+		a.queue = make(chan auditEntry, auditBufferSize)
+		go a.write()
+	})
+	// only waits if the writer is a whole buffer behind, dropping
+	// the entry instead would leave a hole in the record
+	a.queue <- entry
+}
+
+func (a *auditLog) write() {
+	size := a.size
+	if size <= 0 {
+		size = defaultAuditSize
+	}
+	for entry := range a.queue {
+		a.mu.Lock()
+		a.seq++
+		entry.Seq = a.seq
+		if len(a.entries) < size {
+			a.entries = append(a.entries, entry)
+		} else {
+			a.entries[a.start] = entry
+			a.start = (a.start + 1) % size
+		}
+		a.mu.Unlock()
+	}
+}
+
+// a copy of tenant's entries in [offset, offset+limit) and how many
+// tenant has in all, of the ones still kept
+func (a *auditLog) page(tenant string, limit, offset int) ([]auditEntry, int) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	entries := []auditEntry{}
+	total := 0
+	for i := range a.entries {
+		entry := a.entries[(a.start+i)%len(a.entries)]
+		if entry.Tenant != tenant {
+			continue
+		}
+		if total >= offset && len(entries) < limit {
+			entries = append(entries, entry)
+		}
+		total++
+	}
+	return entries, total
+}
+
+// the audit log, oldest first, paginated like GET /users. it lists who
+// changed what from where, so only admins may read it
+func (s *Server) listAudit(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	limit, offset, err := parsePagination(r.URL.Query())
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	entries, total := s.audit.page(tenantFromContext(r.Context()), limit, offset)
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, r, http.StatusOK, entries)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// the role allowed to delete users and use /admin
+const roleAdmin = "admin"
+
+// who a request was authenticated as and what they may do
+type identity struct {
+	// a basic auth username, "api-key-N" or a token's subject
+	Name string
+	// "" for none, which is enough for anything but requireRole
+	Role string
+}
+
+// context key for the identity a request was authenticated with
+type identityKey struct{}
+
+// who a request was authenticated as, "" if it wasn't
+func userFromContext(ctx context.Context) string {
+	return identityFromContext(ctx).Name
+}
+
+// the role a request was authenticated with, "" if it has none or wasn't
+func roleFromContext(ctx context.Context) string {
+	return identityFromContext(ctx).Role
+}
+
+func identityFromContext(ctx context.Context) identity {
+	id, _ := ctx.Value(identityKey{}).(identity)
+	return id
+}
+
+// reads that are for admins only, by path. everything under /admin/ is too
+var adminReads = map[string]bool{
+	"/audit":            true,
+	v1Prefix + "/audit": true,
+}
+
+// true for requests that change something or reach the admin endpoints,
+// the ones that need credentials. reads of users stay public, unless they
+// ask for deleted users too, which only admins may see
+func requiresAuth(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if strings.HasPrefix(r.URL.Path, "/admin/") || adminReads[r.URL.Path] {
+			return true
+		}
+		// a bad value isn't auth's business, the handler answers 400 for it
+		withDeleted, _ := parseBoolParam(r.URL.Query(), "include_deleted")
+		return withDeleted && r.Method != http.MethodOptions
+	}
+	return true
+}
+
+// checks one kind of credentials on a request, returning who they
+// belong to. ok is false when they're missing or wrong
+type authenticator func(r *http.Request) (id identity, ok bool)
+
+// hashed so comparisons take as long whatever the lengths
+func credentialHash(s string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(s))
+}
+
+// HTTP Basic credentials, named after the username. there's only the one
+// pair, whoever has it runs the server, so it always comes with roleAdmin
+func basicAuth(username, password string) authenticator {
+	wantUser := credentialHash(username)
+	wantPass := credentialHash(password)
+	return func(r *http.Request) (identity, bool) {
+		user, pass, ok := r.BasicAuth()
+		gotUser := credentialHash(user)
+		gotPass := credentialHash(pass)
+		// both compared every time, so a right username isn't any slower to reject
+		userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:])
+		passOK := subtle.ConstantTimeCompare(gotPass[:], wantPass[:])
+		return identity{Name: user, Role: roleAdmin}, ok && userOK&passOK == 1
+	}
+}
+
+// an X-API-Key header holding one of keys. each is "key" or "key:role",
+// the key itself can't have a colon in it. it's named "api-key-N", N being
+// the key's position in the list, so the key never ends up in the audit log
+func apiKeyAuth(keys []string) authenticator {
+	want := make([][sha256.Size]byte, len(keys))
+	roles := make([]string, len(keys))
+	for i, entry := range keys {
+		key, role, _ := strings.Cut(entry, ":")
+		want[i] = credentialHash(key)
+		roles[i] = role
+	}
+	return func(r *http.Request) (identity, bool) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			return identity{}, false
+		}
+		got := credentialHash(key)
+		// every key is compared, so how long this takes doesn't say which one nearly matched
+		match := -1
+		for i := range want {
+			if subtle.ConstantTimeCompare(got[:], want[i][:]) == 1 {
+				match = i
+			}
+		}
+		if match < 0 {
+			return identity{}, false
+		}
+		return identity{Name: fmt.Sprintf("api-key-%d", match+1), Role: roles[match]}, true
+	}
+}
+
+// the signing methods a token may use with a shared secret. anything
+// else, "none" especially, is rejected before the signature is checked
+var jwtMethods = []string{"HS256", "HS384", "HS512"}
+
+// a little slack for clocks that don't quite agree with the issuer's
+const jwtLeeway = 30 * time.Second
+
+// what jwtAuth reads from a token, the standard claims and its role
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	Role string `json:"role"`
+}
+
+// an "Authorization: Bearer" JWT signed with secret that hasn't expired,
+// named after its sub claim with the role from its role claim. tokens
+// without exp or sub don't count
+func jwtAuth(secret []byte) authenticator {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	keyFunc := func(*jwt.Token) (any, error) {
+		return secret, nil
+	}
+	return func(r *http.Request) (identity, bool) {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return identity{}, false
+		}
+		var claims jwtClaims
+		if _, err := parser.ParseWithClaims(strings.TrimSpace(token), &claims, keyFunc); err != nil {
+			return identity{}, false
+		}
+		if claims.Subject == "" {
+			return identity{}, false
+		}
+		return identity{Name: claims.Subject, Role: claims.Role}, true
+	}
+}
+
+// lets a request requiresAuth picks out through when any of auths accepts
+// it and answers 401 otherwise, with a WWW-Authenticate for each of challenges
+func authMiddleware(challenges []string, auths ...authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			if !requiresAuth(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, auth := range auths {
+				if id, ok := auth(r); ok {
+					ctx := context.WithValue(r.Context(), identityKey{}, id)
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+
+			for _, challenge := range challenges {
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+			writeJSONError(
+				w,
+				http.StatusUnauthorized,
+				"authentication required",
+			)
+		})
+	}
+}
+
+// wraps handlers that only callers with role may use, anyone else gets
+// a 403. requiresAuth has to cover their routes, or no one would have a
+// role by the time they run. without any auth configured everyone may
+// do everything, so this lets every request through as well
+func (s *Server) requireRole(role string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if auths, _ := s.authenticators(); len(auths) == 0 {
+			return next
+		}
+		return func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			if !s.hasRole(r, role) {
+				writeJSONError(
+					w,
+					http.StatusForbidden,
+					fmt.Sprintf("only the %s role may do this", role),
+				)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// whether r may do what needs role, the check behind requireRole for
+// handlers that only need it for some requests. everyone may without any
+// auth configured
+func (s *Server) hasRole(r *http.Request, role string) bool {
+	if auths, _ := s.authenticators(); len(auths) == 0 {
+		return true
+	}
+	return roleFromContext(r.Context()) == role
+}
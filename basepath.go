@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// context key for the path clients see in front of ours, see pathPrefix
+type pathPrefixKey struct{}
+
+// serves everything under base, e.g. /api/v1/users for /v1/users, and
+// answers anything outside it with a 404. with trustProxy it also takes
+// X-Forwarded-Prefix, for proxies that strip a prefix before passing the
+// request on, so the urls handlers build still point back through them
+func basePathMiddleware(base string, trustProxy bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			prefix := base
+			if trustProxy {
+				prefix = forwardedPrefix(r) + base
+			}
+
+			if base != "" {
+				path, ok := strings.CutPrefix(r.URL.Path, base)
+				if !ok || (path != "" && path[0] != '/') {
+					writeJSONError(
+						w,
+						http.StatusNotFound,
+						"not found",
+					)
+					return
+				}
+				// the same as http.StripPrefix, other middleware keeps the original r
+				u := *r.URL
+				u.Path = path
+				if u.Path == "" {
+					u.Path = "/"
+				}
+				u.RawPath = strings.TrimPrefix(u.RawPath, base)
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.URL = &u
+				r = r2
+			}
+
+			ctx := context.WithValue(r.Context(), pathPrefixKey{}, prefix)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// X-Forwarded-Prefix without its trailing slash, "" if it's missing
+// or not a plain absolute path. it ends up in Location and Link headers,
+// so nothing that could make those point at another host
+func forwardedPrefix(r *http.Request) string {
+	prefix := strings.TrimRight(r.Header.Get("X-Forwarded-Prefix"), "/")
+	if prefix == "" || prefix[0] != '/' || strings.HasPrefix(prefix, "//") {
+		return ""
+	}
+	for i := 0; i < len(prefix); i++ {
+		if prefix[i] <= ' ' || prefix[i] > '~' || prefix[i] == '<' || prefix[i] == '>' {
+			return ""
+		}
+	}
+	return prefix
+}
+
+// what goes in front of our own paths in urls sent to clients, the base
+// path and whatever prefix the proxy removed. "" when served at the root
+func pathPrefix(ctx context.Context) string {
+	prefix, _ := ctx.Value(pathPrefixKey{}).(string)
+	return prefix
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// a weak validator for a json body, it changes whenever any field does
+// (including updated_at, which every write bumps)
+func weakETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// reports whether something last modified at modified is unchanged since
+// an If-Modified-Since header. HTTP dates are whole seconds, so modified
+// is too, or a change in the same second would look newer forever
+// a date that doesn't parse never matches, the client gets the full body
+func notModifiedSince(ifModifiedSince string, modified time.Time) bool {
+	if ifModifiedSince == "" {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// reports whether an If-None-Match header matches etag, using the weak
+// comparison RFC 9110 asks for: W/"x" and "x" are the same
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything main needs to build and run the server. A
+// setting has the same name in a config file as the flag that sets it,
+// e.g. "request-timeout: 5s" for -request-timeout=5s.
+type Config struct {
+	// where the settings were read from, "" when there's no file
+	File string `yaml:"-"`
+
+	Addr string `yaml:"addr"`
+	// serve everything under this path, e.g. /api
+	BasePath string `yaml:"base-path"`
+
+	// memory, sqlite or redis
+	Store string `yaml:"store"`
+	// memory store only
+	DataFile     string        `yaml:"data"`
+	TTL          time.Duration `yaml:"ttl"`
+	TTLSweep     time.Duration `yaml:"ttl-sweep"`
+	MaxEntries   int           `yaml:"max-entries"`
+	MaxUsers     int           `yaml:"max-users"`
+	FoldNameCase bool          `yaml:"fold-name-case"`
+	// how often to save to DataFile while running, zero only saves on shutdown
+	SnapshotInterval time.Duration `yaml:"snapshot-interval"`
+	// sqlite store only
+	DBPath string `yaml:"db"`
+	// redis store only
+	RedisAddr string `yaml:"redis-addr"`
+
+	CollapseNameSpaces bool `yaml:"collapse-name-spaces"`
+
+	// scope users by X-Tenant-ID, memory store only
+	Tenants       bool `yaml:"tenants"`
+	RequireTenant bool `yaml:"require-tenant"`
+	MaxTenants    int  `yaml:"max-tenants"`
+
+	RequestTimeout    time.Duration `yaml:"request-timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read-header-timeout"`
+	ReadTimeout       time.Duration `yaml:"read-timeout"`
+	WriteTimeout      time.Duration `yaml:"write-timeout"`
+	IdleTimeout       time.Duration `yaml:"idle-timeout"`
+	MaxConns          int           `yaml:"max-conns"`
+	// how long /readyz fails before shutting down, for load balancers to notice
+	DrainDelay time.Duration `yaml:"drain-delay"`
+	// how long in-flight requests get to finish once we're asked to stop
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+
+	RateLimit   float64  `yaml:"rate-limit"`
+	RateBurst   int      `yaml:"rate-burst"`
+	TrustProxy  bool     `yaml:"trust-proxy"`
+	CORSOrigins []string `yaml:"cors-origins"`
+
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+
+	// serve reads but answer writes with a 503, for maintenance
+	ReadOnly bool `yaml:"read-only"`
+	// how many changes GET /audit keeps
+	AuditSize int `yaml:"audit-size"`
+
+	Pprof    bool     `yaml:"pprof"`
+	Pretty   bool     `yaml:"pretty"`
+	Webhooks []string `yaml:"webhooks"`
+
+	AuthUser     string   `yaml:"auth-user"`
+	AuthPassword string   `yaml:"auth-password"`
+	APIKeys      []string `yaml:"api-keys"`
+	JWTSecret    string   `yaml:"jwt-secret"`
+
+	LogFormat string `yaml:"log-format"`
+	LogLevel  string `yaml:"log-level"`
+}
+
+// the settings a running server picks up again on SIGHUP, by config key
+var reloadableSettings = map[string]bool{
+	"log-level":    true,
+	"rate-limit":   true,
+	"rate-burst":   true,
+	"cors-origins": true,
+	"read-only":    true,
+}
+
+// what every setting is when nothing else says otherwise
+func defaultConfig() Config {
+	return Config{
+		Addr:       ":8080",
+		Store:      "memory",
+		TTLSweep:   time.Minute,
+		DBPath:     "users.db",
+		RedisAddr:  "localhost:6379",
+		MaxTenants: defaultMaxTenants,
+
+		RequestTimeout:    defaultRequestTimeout,
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		ReadTimeout:       defaultReadTimeout,
+		WriteTimeout:      defaultWriteTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+		ShutdownTimeout:   defaultShutdownTimeout,
+
+		// no RateLimit, limiting is for operators to opt into with -rate-limit
+		RateBurst:   20,
+		CORSOrigins: []string{"*"},
+
+		AuditSize: defaultAuditSize,
+
+		LogFormat: "text",
+		LogLevel:  "info",
+	}
+}
+
+// LoadConfig reads a YAML file, JSON being fine too, over the defaults.
+// Settings the file leaves out keep their default, ones it doesn't know
+// are an error.
+func LoadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// a typo would otherwise quietly leave the setting at its default
+	dec.KnownFields(true)
+	// an empty file is just no settings
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("decode %s: %w", path, err)
+	}
+	cfg.File = path
+	return cfg, nil
+}
+
+// the keys of the settings that differ between c and other, in the
+// order Config has them
+func (c Config) changed(other Config) []string {
+	var keys []string
+	a, b := reflect.ValueOf(c), reflect.ValueOf(other)
+	for i := range a.NumField() {
+		key := a.Type().Field(i).Tag.Get("yaml")
+		if key == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// the settings with an environment variable, which goes over the file.
+// secrets especially, flags show up in ps and the environment doesn't
+func (c *Config) applyEnv() {
+	// ADDR takes a full address, PORT just a port like most platforms inject
+	if addr := os.Getenv("ADDR"); addr != "" {
+		c.Addr = addr
+	} else if port := os.Getenv("PORT"); port != "" {
+		c.Addr = ":" + port
+	}
+	if v := os.Getenv("AUTH_USER"); v != "" {
+		c.AuthUser = v
+	}
+	if v := os.Getenv("AUTH_PASSWORD"); v != "" {
+		c.AuthPassword = v
+	}
+	if v := os.Getenv("API_KEYS"); v != "" {
+		c.APIKeys = splitList(v)
+	}
+	if v := os.Getenv("JWT_SECRET"); v != "" {
+		c.JWTSecret = v
+	}
+}
+
+// the command line flags, each setting the field of c it's named after.
+// c's values are the defaults, so parsing leaves unset flags' fields alone
+func (c *Config) flagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, errorHandling)
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on ($ADDR, or :$PORT)")
+	fs.StringVar(&c.BasePath, "base-path", c.BasePath, "serve everything under this path, e.g. /api when a proxy passes its prefix on")
+	fs.StringVar(&c.Store, "store", c.Store, "storage backend: memory, sqlite or redis")
+	fs.StringVar(&c.DataFile, "data", c.DataFile, "memory store: JSON file to load users from at startup and save them to on shutdown")
+	fs.DurationVar(&c.TTL, "ttl", c.TTL, "memory store: forget users this long after they were last written, 0 keeps them forever")
+	fs.DurationVar(&c.TTLSweep, "ttl-sweep", c.TTLSweep, "memory store: how often to reclaim users that outlived -ttl")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", c.SnapshotInterval, "memory store: also save users to -data this often while running, 0 only saves on shutdown")
+	fs.IntVar(&c.MaxEntries, "max-entries", c.MaxEntries, "memory store: keep at most this many users, evicting the least recently used, 0 for no limit")
+	fs.IntVar(&c.MaxUsers, "max-users", c.MaxUsers, "memory store: refuse to create users past this many with a 507, 0 for no limit")
+	fs.BoolVar(&c.FoldNameCase, "fold-name-case", c.FoldNameCase, "memory store: names that only differ in case count as the same, each is still stored as given")
+	fs.StringVar(&c.DBPath, "db", c.DBPath, "sqlite store: path to the database file")
+	fs.StringVar(&c.RedisAddr, "redis-addr", c.RedisAddr, "redis store: host:port of the redis server")
+	fs.BoolVar(&c.CollapseNameSpaces, "collapse-name-spaces", c.CollapseNameSpaces, "store new names with runs of whitespace inside them turned into one space, they're always trimmed")
+	fs.BoolVar(&c.Tenants, "tenants", c.Tenants, "memory store: keep each X-Tenant-ID's users apart, requests without one share a tenant")
+	fs.BoolVar(&c.RequireTenant, "require-tenant", c.RequireTenant, "with -tenants, answer requests without X-Tenant-ID with a 400 instead")
+	fs.IntVar(&c.MaxTenants, "max-tenants", c.MaxTenants, "with -tenants, answer writes for a tenant past this many with a 507, 0 for no limit")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "how long a request may take before it gets a 503")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "how long a client gets to send its request headers")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "how long a client gets to send a whole request")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "how long writing a response may take")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long an idle keep-alive connection stays open")
+	fs.IntVar(&c.MaxConns, "max-conns", c.MaxConns, "most client connections open at once, more wait to be accepted, 0 for no limit")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long requests get to finish on shutdown before their connections are closed")
+	fs.DurationVar(&c.DrainDelay, "drain-delay", c.DrainDelay, "how long /readyz answers 503 before shutting down, e.g. a load balancer's probe interval")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "requests per second allowed per client ip, 0 disables")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "requests a client may burst above -rate-limit")
+	fs.BoolVar(&c.TrustProxy, "trust-proxy", c.TrustProxy, "rate limit by X-Forwarded-For and build urls with X-Forwarded-Prefix, only when running behind a proxy that sets them")
+	fs.Var(listFlag{&c.CORSOrigins}, "cors-origins", "comma-separated origins allowed to call the API from a browser, * for any")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file, serves https when set together with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file")
+	fs.BoolVar(&c.ReadOnly, "read-only", c.ReadOnly, "serve reads but answer every write with a 503, e.g. during maintenance")
+	fs.IntVar(&c.AuditSize, "audit-size", c.AuditSize, "how many of the latest changes GET /audit keeps, older ones are dropped")
+	fs.BoolVar(&c.Pprof, "pprof", c.Pprof, "serve profiling data under /debug/pprof/ and expvar at /debug/vars, never on a publicly reachable port")
+	fs.BoolVar(&c.Pretty, "pretty", c.Pretty, "indent JSON and XML responses by default, requests can still ask with ?pretty=")
+	fs.Var(listFlag{&c.Webhooks}, "webhooks", "comma-separated urls to POST a JSON event to whenever a user changes")
+	fs.StringVar(&c.AuthUser, "auth-user", c.AuthUser, "username writes and /admin need over basic auth, prefer $AUTH_USER")
+	fs.StringVar(&c.AuthPassword, "auth-password", c.AuthPassword, "password for -auth-user, prefer $AUTH_PASSWORD")
+	fs.Var(listFlag{&c.APIKeys}, "api-keys", "comma-separated keys accepted in X-API-Key instead of basic auth, key:admin for ones that may delete, prefer $API_KEYS")
+	fs.StringVar(&c.JWTSecret, "jwt-secret", c.JWTSecret, "HMAC secret bearer tokens must be signed with, prefer $JWT_SECRET")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log output: text or json")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "least severe level to log: debug, info, warn or error")
+	return fs
+}
+
+// sets a []string from a comma-separated flag value
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	// flag makes a zero listFlag to find out what an unset one looks like
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	*f.list = splitList(s)
+	return nil
+}
+
+// Validate reports the first setting that can't work, so main can
+// refuse to start rather than fail later on.
+func (c *Config) Validate() error {
+	switch c.Store {
+	case "memory":
+		if c.TTL > 0 && c.TTLSweep <= 0 {
+			return errors.New("ttl-sweep must be positive")
+		}
+		if c.SnapshotInterval > 0 && c.DataFile == "" {
+			return errors.New("snapshot-interval needs data set")
+		}
+		// only the shared tenant would be saved, everyone else's users
+		// would be gone after a restart
+		if c.Tenants && c.DataFile != "" {
+			return errors.New("tenants can't be used with data")
+		}
+	case "sqlite", "redis":
+		if c.TTL != 0 || c.MaxEntries != 0 || c.MaxUsers != 0 || c.SnapshotInterval != 0 || c.Tenants || c.FoldNameCase {
+			return errors.New("ttl, max-entries, max-users, snapshot-interval, tenants and fold-name-case only work with store memory")
+		}
+	default:
+		return fmt.Errorf("store must be memory, sqlite or redis, got %q", c.Store)
+	}
+	if c.RequireTenant && !c.Tenants {
+		return errors.New("require-tenant needs tenants set")
+	}
+	if c.TTL < 0 || c.MaxEntries < 0 || c.MaxUsers < 0 || c.SnapshotInterval < 0 || c.MaxTenants < 0 {
+		return errors.New("ttl, max-entries, max-users, snapshot-interval and max-tenants must not be negative")
+	}
+
+	timeouts := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"request-timeout", c.RequestTimeout},
+		{"read-header-timeout", c.ReadHeaderTimeout},
+		{"read-timeout", c.ReadTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"shutdown-timeout", c.ShutdownTimeout},
+	}
+	for _, t := range timeouts {
+		if t.d <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", t.name, t.d)
+		}
+	}
+	// it's matched against request paths as is, "/api/" would need "/api//v1/users"
+	if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.HasSuffix(c.BasePath, "/")) {
+		return fmt.Errorf("base-path must start with / and not end with one, got %q", c.BasePath)
+	}
+	if c.AuditSize <= 0 {
+		return fmt.Errorf("audit-size must be positive, got %d", c.AuditSize)
+	}
+	if c.MaxConns < 0 {
+		return errors.New("max-conns must not be negative")
+	}
+	if c.DrainDelay < 0 {
+		return errors.New("drain-delay must not be negative")
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return errors.New("rate-limit and rate-burst must not be negative")
+	}
+
+	// one without the other is almost certainly a typo, don't quietly serve http
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	// with only one of them set, auth would be off without anyone noticing
+	if (c.AuthUser == "") != (c.AuthPassword == "") {
+		return errors.New("auth-user and auth-password must be set together")
+	}
+	for _, hook := range c.Webhooks {
+		// deliveries fail quietly in the background, so catch typos now
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks must be http(s) urls, got %q", hook)
+		}
+	}
+
+	if _, err := parseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if _, err := newLogger(c.LogFormat, slog.LevelInfo); err != nil {
+		return err
+	}
+	return nil
+}
+
+// the slog level a log-level setting names
+func parseLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("log-level must be debug, info, warn or error, got %q", level)
+	}
+	return lvl, nil
+}
+
+// builds the logger log-format asks for, logging level and above.
+// a *slog.LevelVar lets the level change later
+func newLogger(format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("log-format must be text or json, got %q", format)
+}
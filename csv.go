@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// column order for the csv export, one per User field
+var csvHeader = []string{"id", "name", "email", "version", "created_at", "updated_at"}
+
+// downloads every user as a spreadsheet, in ascending id order
+func (s *Server) exportCSV(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	// one List call copies the users out in a single read, so the store
+	// isn't held up while we write and the file can't mix two states
+	users, err := s.store(r.Context()).List(r.Context(), math.MaxInt, 0, false)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+
+	cw := csv.NewWriter(w)
+	// with no users the file is just the header
+	cw.Write(csvHeader)
+	for _, user := range users {
+		cw.Write(csvRecord(user))
+	}
+	cw.Flush()
+	// the status is already sent, all we can do is note it
+	if err := cw.Error(); err != nil {
+		s.logger().Error("csv export failed", "request_id", requestIDFromContext(r.Context()), "err", err)
+	}
+}
+
+// a user as a row under csvHeader
+func csvRecord(user User) []string {
+	return []string{
+		strconv.Itoa(user.ID),
+		user.Name,
+		user.Email,
+		strconv.Itoa(user.Version),
+		user.CreatedAt.Format(time.RFC3339Nano),
+		user.UpdatedAt.Format(time.RFC3339Nano),
+	}
+}
+
+// what POST /users/import sends back
+type importResult struct {
+	Created int             `json:"created"`
+	Failed  []importFailure `json:"failed"`
+}
+
+// a row that wasn't imported, Line is where it starts in the file
+type importFailure struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+	// the name or email belongs to someone else, the row itself was fine
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+// a row of the uploaded file and the line it started on
+type csvRow struct {
+	line   int
+	fields []string
+}
+
+// creates a user per row of an uploaded csv file, skipping rows that fail
+// the first row is a header naming the columns, name and email are required
+// and anything else is ignored, so a file from GET /users.csv imports as is
+func (s *Server) importCSV(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if !requireContentType(w, r, "text/csv") {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes())
+
+	header, rows, err := readCSV(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body must not exceed %d bytes", tooLarge.Limit),
+		)
+		return
+	}
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	nameCol, emailCol := -1, -1
+	for i, column := range header {
+		switch strings.ToLower(strings.TrimSpace(column)) {
+		case "name":
+			nameCol = i
+		case "email":
+			emailCol = i
+		}
+	}
+	if nameCol < 0 || emailCol < 0 {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			codedErrorf("invalid_csv_header", "csv header must have name and email columns"),
+		)
+		return
+	}
+
+	result := importResult{Failed: []importFailure{}}
+	for _, row := range rows {
+		// the client has given up, stop creating users it won't hear about
+		if r.Context().Err() != nil {
+			return
+		}
+
+		if len(row.fields) != len(header) {
+			result.Failed = append(result.Failed, importFailure{
+				Line:  row.line,
+				Error: fmt.Sprintf("row has %d fields, header has %d", len(row.fields), len(header)),
+			})
+			continue
+		}
+
+		user := User{
+			Name:  row.fields[nameCol],
+			Email: row.fields[emailCol],
+		}
+		if err := s.validateUser(&user); err != nil {
+			result.Failed = append(result.Failed, importFailure{
+				Line:  row.line,
+				Error: err.Error(),
+			})
+			continue
+		}
+
+		// each row goes in on its own so one taken name doesn't stop the rest
+		span := storeSpan(r.Context(), "Create")
+		user, err := s.store(r.Context()).Create(r.Context(), user)
+		if err == nil {
+			span.SetAttributes(attribute.Int("user.id", user.ID))
+		}
+		span.End()
+		if err != nil {
+			result.Failed = append(result.Failed, importFailure{
+				Line:     row.line,
+				Error:    err.Error(),
+				Conflict: isConflict(err),
+			})
+			continue
+		}
+		s.publish(r, userEvent{Type: eventCreated, ID: user.ID, User: &user})
+		result.Created++
+	}
+
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// reads the whole file before anything is created, so a malformed one
+// is refused outright instead of being half imported
+func readCSV(body io.Reader) ([]string, []csvRow, error) {
+	cr := csv.NewReader(body)
+	// rows with the wrong number of fields are reported one by one instead
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, codedErrorf("csv_empty", "csv file is empty")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// spreadsheets like to start files with a byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	var rows []csvRow
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return header, rows, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		rows = append(rows, csvRow{line: line, fields: fields})
+	}
+}
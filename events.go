@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how many events a subscriber may fall behind before it's dropped
+const eventBufferSize = 16
+
+// a quiet stream gets a comment line this often so proxies don't time it out
+const eventKeepAlive = 30 * time.Second
+
+// what GET /users/events sends for each change
+// User is missing for deletes, there's only the id left by then
+type userEvent struct {
+	Type string `json:"type"`
+	ID   int    `json:"id,omitempty"`
+	User *User  `json:"user,omitempty"`
+	// whose user it was, missing for the shared tenant. streams only get
+	// their own tenant's events, webhooks get everyone's
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// event types, see userEvent
+const (
+	eventCreated    = "created"
+	eventUpdated    = "updated"
+	eventRestored   = "restored"
+	eventDeletedAll = "deleted_all"
+	// everything was replaced by POST /admin/restore, clients should reload
+	eventSnapshotLoaded = "snapshot_loaded"
+
+	// deleted is a soft delete that restored can undo, purged is for good
+	eventDeleted = "deleted"
+	eventPurged  = "purged"
+)
+
+// fans user changes out to every open event stream
+// the zero value is ready to use
+type eventBus struct {
+	mu sync.Mutex
+	// each subscriber and the tenant it's listening to
+	subs   map[chan userEvent]string
+	closed bool
+}
+
+// returns a channel that gets every event for tenant published from now on
+// it's closed if the subscriber falls behind or the bus shuts down
+func (b *eventBus) subscribe(tenant string) chan userEvent {
+	ch := make(chan userEvent, eventBufferSize)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	if b.subs == nil {
+		b.subs = make(map[chan userEvent]string)
+	}
+	b.subs[ch] = tenant
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan userEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// publish may have dropped it already, and closed it with it
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// never blocks, a subscriber whose buffer is full is dropped instead of
+// holding up the handler that made the change
+func (b *eventBus) publish(ev userEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, tenant := range b.subs {
+		if tenant != ev.Tenant {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// ends every stream and refuses new ones, for shutting down
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// records a change the handler just made in the audit log and tells
+// event streams and webhooks about it
+func (s *Server) publish(r *http.Request, ev userEvent) {
+	ev.Tenant = tenantFromContext(r.Context())
+	s.audit.record(auditEntry{
+		Tenant:     ev.Tenant,
+		Time:       time.Now().UTC(),
+		Action:     ev.Type,
+		UserID:     ev.ID,
+		RequestID:  requestIDFromContext(r.Context()),
+		RemoteAddr: r.RemoteAddr,
+		Actor:      userFromContext(r.Context()),
+	})
+	s.events.publish(ev)
+
+	s.webhooksOnce.Do(func() {
+		s.webhooks = newWebhookNotifier(s.WebhookURLs, s.logger())
+	})
+	s.webhooks.send(ev)
+}
+
+// streams user changes as server-sent events until the client goes away
+func (s *Server) streamEvents(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	rc := http.NewResponseController(w)
+	// the server's timeouts are meant for ordinary requests, this one stays open
+	// not every writer supports deadlines (httptest's doesn't), that's fine
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	events := s.events.subscribe(tenantFromContext(r.Context()))
+	defer s.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// get the headers out now, otherwise the client waits for the first event
+	if err := rc.Flush(); err != nil {
+		s.logger().Error("event stream failed", "request_id", requestIDFromContext(r.Context()), "err", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			// dropped for falling behind, or shutting down
+			// EventSource reconnects by itself
+			if !ok {
+				return
+			}
+			j, err := json.Marshal(ev)
+			if err != nil {
+				s.logger().Error("event stream failed", "request_id", requestIDFromContext(r.Context()), "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", j)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		}
+
+		// the client is gone if this fails
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// /debug/vars the way expvar.Handler serves it, cmdline and memstats
+// included, plus this server's own vars. those aren't published on the
+// global expvar, which panics when a second Server registers the same names
+func (s *Server) varsHandler() http.Handler {
+	start := time.Now()
+
+	// only worked out when someone reads /debug/vars, requests just
+	// bump the counters in s.stats
+	vars := new(expvar.Map)
+	vars.Set("requests", expvar.Func(func() any {
+		return s.stats.requests.Load()
+	}))
+	vars.Set("requests_by_status", expvar.Func(func() any {
+		classes := make(map[string]int64, len(s.stats.requestsByClass)-1)
+		for class := 1; class < len(s.stats.requestsByClass); class++ {
+			classes[fmt.Sprintf("%dxx", class)] = s.stats.requestsByClass[class].Load()
+		}
+		return classes
+	}))
+	// the shared tenant's, live ones only like GET /users/count
+	vars.Set("users", expvar.Func(func() any {
+		count, err := s.Store.Count(context.Background(), false)
+		if err != nil {
+			return nil
+		}
+		return count
+	}))
+	vars.Set("uptime_seconds", expvar.Func(func() any {
+		return time.Since(start).Seconds()
+	}))
+
+	return http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		first := true
+		write := func(kv expvar.KeyValue) {
+			if !first {
+				fmt.Fprintf(w, ",\n")
+			}
+			first = false
+			fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+		}
+		expvar.Do(write)
+		vars.Do(write)
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// the keys ?fields=name,email asks for, or nil when the client wants every field
+// names that aren't User json keys are simply never matched
+func parseFields(q url.Values) map[string]bool {
+	if !q.Has("fields") {
+		return nil
+	}
+
+	fields := map[string]bool{}
+	for _, name := range strings.Split(q.Get("fields"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// a user cut down to some of its fields, named by their json keys
+type userFields struct {
+	user   User
+	fields map[string]bool
+}
+
+func (u userFields) MarshalJSON() ([]byte, error) {
+	// go through the json so the keys and formatting are the ones clients know
+	j, err := json.Marshal(u.user)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(j, &all); err != nil {
+		return nil, err
+	}
+
+	picked := make(map[string]json.RawMessage, len(u.fields))
+	for key, value := range all {
+		if u.fields[key] {
+			picked[key] = value
+		}
+	}
+	return json.Marshal(picked)
+}
+
+// the fields as children of a <user>, in the order User declares them
+func (u userFields) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = "user"
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(u.user)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !u.fields[key] {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("xml"), ",")
+		// a nil DeletedAt encodes to nothing, like omitempty
+		if err := e.EncodeElement(v.Field(i).Interface(), xml.StartElement{Name: xml.Name{Local: name}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// user trimmed down to fields, or user itself when fields is nil
+func selectFields(user User, fields map[string]bool) any {
+	if fields == nil {
+		return user
+	}
+	return userFields{user: user, fields: fields}
+}
+
+// selectFields for every user, keeping their order
+func selectFieldsAll(users []User, fields map[string]bool) any {
+	if fields == nil {
+		return users
+	}
+
+	picked := make([]userFields, len(users))
+	for i, user := range users {
+		picked[i] = userFields{user: user, fields: fields}
+	}
+	return picked
+}
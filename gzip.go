@@ -0,0 +1,196 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// responses smaller than this go out as they are, gzip's header and
+// footer would eat most of the saving
+const gzipMinSize = 1024
+
+// gzip writers are expensive to allocate, reuse them across requests
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// compresses responses for clients that send Accept-Encoding: gzip
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		// the response differs by Accept-Encoding whether we compress or not
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{
+			ResponseWriter: w,
+			status:         http.StatusOK,
+		}
+		defer gw.Close()
+
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// true unless gzip is missing from the header or explicitly refused with q=0
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) == "q" {
+				q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// holds back the first gzipMinSize bytes to decide whether compressing is
+// worth it, then either streams through gzip or writes them out as they are
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	status      int
+	wroteHeader bool
+	buf         []byte
+
+	// set once we've decided, at most one of them is true
+	compressing bool
+	passthrough bool
+	gz          *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	gw.status = status
+
+	// informational responses aren't the real one and go straight through
+	if status < 200 {
+		gw.wroteHeader = false
+		gw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	gw.wroteHeader = true
+
+	switch {
+	case gw.compressing:
+		return gw.gz.Write(p)
+	case gw.passthrough:
+		return gw.ResponseWriter.Write(p)
+	}
+
+	gw.buf = append(gw.buf, p...)
+	if len(gw.buf) >= gzipMinSize {
+		if err := gw.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// sends the headers with Content-Encoding: gzip and compresses what's buffered
+func (gw *gzipResponseWriter) startGzip() error {
+	h := gw.Header()
+	// a handler that already encoded its body, or a status that has no body
+	if h.Get("Content-Encoding") != "" || !bodyAllowed(gw.status) {
+		return gw.startPassthrough()
+	}
+
+	// sniff from the uncompressed bytes, net/http would otherwise sniff gzip
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(gw.buf))
+	}
+	h.Set("Content-Encoding", "gzip")
+	// the handler's length was for the uncompressed body
+	h.Del("Content-Length")
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	gw.gz = gzipWriterPool.Get().(*gzip.Writer)
+	gw.gz.Reset(gw.ResponseWriter)
+	gw.compressing = true
+
+	buf := gw.buf
+	gw.buf = nil
+	_, err := gw.gz.Write(buf)
+	return err
+}
+
+// sends the headers and whatever is buffered untouched
+func (gw *gzipResponseWriter) startPassthrough() error {
+	gw.passthrough = true
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	if len(gw.buf) == 0 {
+		return nil
+	}
+	buf := gw.buf
+	gw.buf = nil
+	_, err := gw.ResponseWriter.Write(buf)
+	return err
+}
+
+// a flush means the handler is streaming, so stop waiting for more bytes
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.compressing && !gw.passthrough {
+		if len(gw.buf) > 0 {
+			gw.startGzip()
+		} else {
+			gw.startPassthrough()
+		}
+	}
+	if gw.compressing {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// finishes the response once the handler returns
+func (gw *gzipResponseWriter) Close() error {
+	if !gw.compressing && !gw.passthrough {
+		// never reached gzipMinSize, not worth compressing
+		return gw.startPassthrough()
+	}
+	if !gw.compressing {
+		return nil
+	}
+
+	// writes the gzip footer, without it clients see a truncated body
+	err := gw.gz.Close()
+	gw.gz.Reset(nil)
+	gzipWriterPool.Put(gw.gz)
+	gw.gz = nil
+	gw.compressing = false
+	gw.passthrough = true
+	return err
+}
+
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// 1xx, 204 and 304 responses never carry a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
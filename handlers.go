@@ -0,0 +1,1522 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// page sizes for listUsers when the client doesn't ask for one
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+func handleRoot(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	fmt.Fprintf(w, "Hello World")
+}
+
+// methods routes get registered for, in the order Allow lists them
+// HEAD comes for free with every GET route
+var routeMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// sits on "/" and gets every request no other route in routes matches
+// for a path that exists under other methods, OPTIONS gets a 204 and
+// anything else a 405, both listing them in Allow. a path that only
+// exists without its trailing slash gets a 308 there, anything else a 404
+func fallbackHandler(routes *http.ServeMux) http.HandlerFunc {
+	return func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		allowed := allowedMethods(routes, r)
+		if len(allowed) == 0 {
+			if target, ok := withoutTrailingSlash(routes, r); ok {
+				// 308 rather than 301 so clients repeat the method and body
+				http.Redirect(w, r, pathPrefix(r.Context())+target, http.StatusPermanentRedirect)
+				return
+			}
+			writeJSONError(
+				w,
+				http.StatusNotFound,
+				"not found",
+			)
+			return
+		}
+		// answered right here for every route, so it's always allowed
+		allowed = append(allowed, http.MethodOptions)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+		// CORS preflights never get here, corsMiddleware answers those
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSONError(
+			w,
+			http.StatusMethodNotAllowed,
+			fmt.Sprintf("method %s not allowed, use %s", r.Method, strings.Join(allowed, ", ")),
+		)
+	}
+}
+
+// r's url without the one trailing slash on its path, if routes has
+// anything there. routes that end in a slash themselves match before this
+// is ever asked, so they keep working
+func withoutTrailingSlash(routes *http.ServeMux, r *http.Request) (string, bool) {
+	path := r.URL.EscapedPath()
+	if path == "/" || !strings.HasSuffix(path, "/") {
+		return "", false
+	}
+	u := *r.URL
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	probe := &http.Request{Method: r.Method, URL: &u, Host: r.Host}
+	if len(allowedMethods(routes, probe)) == 0 {
+		return "", false
+	}
+	return u.RequestURI(), true
+}
+
+// the methods routes has a real route for at r's path, not counting "/"
+func allowedMethods(routes *http.ServeMux, r *http.Request) []string {
+	var allowed []string
+	for _, method := range routeMethods {
+		probe := &http.Request{
+			Method: method,
+			URL:    r.URL,
+			Host:   r.Host,
+		}
+		if _, pattern := routes.Handler(probe); pattern != "" && pattern != "/" {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// liveness only: never touches the store so a slow writer
+// holding the lock can't make the process look dead
+func handleHealth(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// how long /readyz waits on the store before calling it unhealthy
+const readyTimeout = time.Second
+
+// readiness: 200 while the store answers, 503 once it doesn't or the
+// server is draining before a shutdown
+func (s *Server) handleReady(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if s.draining.Load() {
+		writeJSONError(
+			w,
+			http.StatusServiceUnavailable,
+			"shutting down",
+		)
+		return
+	}
+	// stores without Ping have nothing that could be down
+	if p, ok := s.Store.(Pinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if err := p.Ping(ctx); err != nil {
+			s.logger().Warn("store ping failed", "err", err)
+			writeJSONError(
+				w,
+				http.StatusServiceUnavailable,
+				"store unavailable",
+			)
+			return
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (s *Server) deleteUser(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+	// ?purge=true removes the user for good instead of marking it deleted
+	purge, err := parseBoolParam(r.URL.Query(), "purge")
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// the request timed out and the client already got a 503,
+	// don't make a change it will never hear about
+	if r.Context().Err() != nil {
+		return
+	}
+
+	if purge {
+		// deletes key-value pair, ErrUserNotFound if the user didn't exist
+		span := storeSpan(r.Context(), "Delete", attribute.Int("user.id", id))
+		err := s.store(r.Context()).Delete(r.Context(), id)
+		span.End()
+		if errors.Is(err, ErrUserNotFound) {
+			writeError(
+				w,
+				http.StatusNotFound,
+				ErrUserNotFound,
+			)
+			return
+		}
+		if err != nil {
+			s.writeStoreError(w, r, err)
+			return
+		}
+		s.publish(r, userEvent{Type: eventPurged, ID: id})
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// keeps the user around so POST /users/{id}/restore can bring it back
+	span := storeSpan(r.Context(), "SoftDelete", attribute.Int("user.id", id))
+	_, err = s.store(r.Context()).SoftDelete(r.Context(), id)
+	span.End()
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(
+			w,
+			http.StatusNotFound,
+			ErrUserNotFound,
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r, userEvent{Type: eventDeleted, ID: id})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// undoes a soft delete, the user comes back as it was with a new version
+func (s *Server) restoreUser(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// the request timed out and the client already got a 503,
+	// don't make a change it will never hear about
+	if r.Context().Err() != nil {
+		return
+	}
+
+	span := storeSpan(r.Context(), "Restore", attribute.Int("user.id", id))
+	user, err := s.store(r.Context()).Restore(r.Context(), id)
+	span.End()
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(
+			w,
+			http.StatusNotFound,
+			ErrUserNotFound,
+		)
+		return
+	}
+	if errors.Is(err, ErrNotDeleted) {
+		writeError(
+			w,
+			http.StatusConflict,
+			err,
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r, userEvent{Type: eventRestored, ID: user.ID, User: &user})
+
+	writeJSON(w, r, http.StatusOK, user)
+}
+
+// wipes every user, meant for test setup and admin tooling
+func (s *Server) deleteAllUsers(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	// the request timed out and the client already got a 503,
+	// don't make a change it will never hear about
+	if r.Context().Err() != nil {
+		return
+	}
+
+	span := storeSpan(r.Context(), "DeleteAll")
+	err := s.store(r.Context()).DeleteAll(r.Context())
+	span.End()
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r, userEvent{Type: eventDeletedAll})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// also serves HEAD, for clients that only want to know whether the user
+// exists or has changed
+func (s *Server) getUser(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	// can get value of path parameter id
+	id, err := pathID(r)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+	// json unless the client asks for xml, checked before any work is done
+	contentType, ok := negotiateContentType(w, r)
+	if !ok {
+		return
+	}
+
+	// retrieve user
+	span := storeSpan(r.Context(), "Get", attribute.Int("user.id", id))
+	user, err := s.store(r.Context()).Get(r.Context(), id)
+	span.End()
+
+	// if user does not exist, soft deleted ones only show up in listUsers
+	if errors.Is(err, ErrUserNotFound) || err == nil && user.DeletedAt != nil {
+		writeError(
+			w,
+			http.StatusNotFound,
+			ErrUserNotFound,
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	// want to return json (or xml) representation of user
+	// error can occur while converting user struct to a valid representation
+	j, err := marshalAs(r, contentType, selectFields(user, parseFields(r.URL.Query())))
+	if err != nil {
+		writeMarshalError(w, r, err)
+		return
+	}
+
+	// lets clients that already have this version skip the download
+	etag := weakETag(j)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", user.UpdatedAt.UTC().Format(http.TimeFormat))
+	// If-Modified-Since only counts without an If-None-Match, RFC 9110 13.1.3
+	notModified := etagMatches(r.Header.Get("If-None-Match"), etag)
+	if r.Header.Get("If-None-Match") == "" {
+		notModified = notModifiedSince(r.Header.Get("If-Modified-Since"), user.UpdatedAt)
+	}
+	if notModified {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeBody(w, r, http.StatusOK, contentType, j)
+}
+
+func (s *Server) getUserByName(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	// PathValue is already url-decoded, so /users/by-name/Bob%20Smith gives "Bob Smith"
+	// and it's normalized like names are when they're stored
+	span := storeSpan(r.Context(), "GetByName")
+	user, err := s.store(r.Context()).GetByName(r.Context(), s.normalizeName(r.PathValue("name")))
+	if err == nil {
+		span.SetAttributes(attribute.Int("user.id", user.ID))
+	}
+	span.End()
+	if errors.Is(err, ErrUserNotFound) || err == nil && user.DeletedAt != nil {
+		writeError(
+			w,
+			http.StatusNotFound,
+			ErrUserNotFound,
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	writeNegotiated(w, r, http.StatusOK, selectFields(user, parseFields(r.URL.Query())))
+}
+
+// the email is normalized like on create, so the host's case doesn't matter
+func (s *Server) getUserByEmail(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	email, err := normalizeEmail(r.PathValue("email"))
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	span := storeSpan(r.Context(), "GetByEmail")
+	user, err := s.store(r.Context()).GetByEmail(r.Context(), email)
+	if err == nil {
+		span.SetAttributes(attribute.Int("user.id", user.ID))
+	}
+	span.End()
+	if errors.Is(err, ErrUserNotFound) || err == nil && user.DeletedAt != nil {
+		writeError(
+			w,
+			http.StatusNotFound,
+			ErrUserNotFound,
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	writeNegotiated(w, r, http.StatusOK, selectFields(user, parseFields(r.URL.Query())))
+}
+
+func (s *Server) listUsers(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	q := r.URL.Query()
+	// ?ids= fetches those users instead of a page, see listUsersByID
+	if q.Has("ids") {
+		s.listUsersByID(w, r)
+		return
+	}
+	limit, offset, err := parsePagination(q)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+	less, err := parseSort(q.Get("sort"))
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+	// soft deleted users are hidden unless an admin asks for them
+	withDeleted, ok := s.parseIncludeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	// ?cursor= switches to cursor pagination, left empty for the first page
+	if q.Has("cursor") {
+		if q.Has("offset") {
+			writeJSONError(
+				w,
+				http.StatusBadRequest,
+				"cursor and offset can't be used together",
+			)
+			return
+		}
+		// cursors are ids, so the pages have to be in id order
+		if less != nil {
+			writeJSONError(
+				w,
+				http.StatusBadRequest,
+				"cursor only works with sort=id",
+			)
+			return
+		}
+		if q.Get("q") != "" {
+			writeJSONError(
+				w,
+				http.StatusBadRequest,
+				"cursor and q can't be used together",
+			)
+			return
+		}
+		s.listUsersAfter(w, r, q.Get("cursor"), limit, parseFields(q), withDeleted)
+		return
+	}
+
+	var users []User
+	var total int
+	search := q.Get("q")
+	switch {
+	case less != nil:
+		// stores hand users out by id, so any other order means taking all of
+		// them and sorting the copy here, outside the store's locks
+		if search != "" {
+			users, _, err = s.store(r.Context()).Search(r.Context(), search, math.MaxInt, 0, withDeleted)
+		} else {
+			users, err = s.store(r.Context()).List(r.Context(), math.MaxInt, 0, withDeleted)
+		}
+		if err != nil {
+			break
+		}
+		total = len(users)
+		// stable so ties stay in id order
+		sort.SliceStable(users, func(i, j int) bool {
+			return less(users[i], users[j])
+		})
+		// offset can be anything up to MaxInt, adding limit to it could overflow
+		start := min(offset, total)
+		users = users[start : start+min(limit, total-start)]
+	case search != "":
+		// ?q= narrows the list to users whose name or email contains it
+		users, total, err = s.store(r.Context()).Search(r.Context(), search, limit, offset, withDeleted)
+	default:
+		users, err = s.store(r.Context()).List(r.Context(), limit, offset, withDeleted)
+		if err == nil {
+			total, err = s.store(r.Context()).Count(r.Context(), withDeleted)
+		}
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	// added rather than set, deprecated routes already put a successor link there
+	w.Header().Add("Link", paginationLinks(pathPrefix(r.Context()), r.URL, limit, offset, total))
+	writeNegotiated(w, r, http.StatusOK, userList{Users: selectFieldsAll(users, parseFields(q))})
+}
+
+// cheap alternative to listing everything just to count it
+func (s *Server) countUsers(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	withDeleted, ok := s.parseIncludeDeleted(w, r)
+	if !ok {
+		return
+	}
+	count, err := s.store(r.Context()).Count(r.Context(), withDeleted)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]int{"count": count})
+}
+
+// GET /users?ids=1,2,3, the users with those ids that exist, in that order
+// ids that don't are listed in X-Missing-Ids rather than failing the request
+// paging, sorting and searching don't apply, ?fields= and ?include_deleted= do
+func (s *Server) listUsersByID(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	q := r.URL.Query()
+	ids, err := parseIDs(q.Get("ids"))
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+	withDeleted, ok := s.parseIncludeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	span := storeSpan(r.Context(), "GetMany", attribute.Int("users.count", len(ids)))
+	found, err := s.store(r.Context()).GetMany(r.Context(), ids)
+	span.End()
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	users := []User{}
+	seen := make(map[int]bool, len(found))
+	for _, user := range found {
+		// a soft deleted user is as missing as one that never existed
+		if user.DeletedAt != nil && !withDeleted {
+			continue
+		}
+		users = append(users, user)
+		seen[user.ID] = true
+	}
+	var missing []string
+	for _, id := range ids {
+		if !seen[id] {
+			missing = append(missing, strconv.Itoa(id))
+		}
+	}
+	if len(missing) > 0 {
+		w.Header().Set("X-Missing-Ids", strings.Join(missing, ","))
+	}
+
+	writeNegotiated(w, r, http.StatusOK, userList{Users: selectFieldsAll(users, parseFields(q))})
+}
+
+// a 500 for a store failure that isn't down to the request, the error
+// itself only goes to the log. nothing at all once the request is over
+func (s *Server) writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	// the client went away or the timeout already sent a 503,
+	// the store only gave up because of that
+	if r.Context().Err() != nil {
+		return
+	}
+	// the store is fine, somebody else kept winning the race for the user
+	if errors.Is(err, ErrWriteConflict) {
+		writeError(
+			w,
+			http.StatusConflict,
+			err,
+		)
+		return
+	}
+	s.logger().Error("store failed", "request_id", requestIDFromContext(r.Context()), "err", err)
+	writeJSONError(
+		w,
+		http.StatusInternalServerError,
+		"internal server error",
+	)
+}
+
+// the {id} in r's path
+func pathID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return 0, codedErrorf("invalid_id", "id must be an integer, got %q", r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// a comma separated list of ids, each one once and in the order given
+// capped at maxListLimit like any other page of users
+func parseIDs(list string) ([]int, error) {
+	var ids []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(list, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, codedErrorf("invalid_ids", "ids must be a comma separated list of integers, got %q", part)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxListLimit {
+		return nil, codedErrorf("invalid_ids", "ids can list at most %d users", maxListLimit)
+	}
+	return ids, nil
+}
+
+// a page of GET /users?cursor=, NextCursor is missing on the last page
+// Users is a []User, or the users cut down by ?fields=
+type userPage struct {
+	XMLName    xml.Name `json:"-" xml:"page"`
+	Users      any      `json:"users" xml:"users>user"`
+	NextCursor string   `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
+}
+
+// GET /users, a bare array in json but xml needs a root element around it
+type userList struct {
+	XMLName xml.Name `xml:"users"`
+	Users   any      `xml:"user"`
+}
+
+func (l userList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Users)
+}
+
+// the page after cursor, which pages stay stable however users come and go
+func (s *Server) listUsersAfter(
+	w http.ResponseWriter,
+	r *http.Request,
+	cursor string,
+	limit int,
+	fields map[string]bool,
+	withDeleted bool,
+) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// one extra tells us whether there's another page without a round trip
+	users, err := s.store(r.Context()).ListAfter(r.Context(), after, limit+1, withDeleted)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	total, err := s.store(r.Context()).Count(r.Context(), withDeleted)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	var page userPage
+	if len(users) > limit {
+		users = users[:limit]
+		page.NextCursor = encodeCursor(users[limit-1].ID)
+	}
+	page.Users = selectFieldsAll(users, fields)
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeNegotiated(w, r, http.StatusOK, page)
+}
+
+// cursors are the last id of a page, base64'd so clients treat them as opaque
+func encodeCursor(lastID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(lastID)))
+}
+
+// the empty cursor is the first page
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, codedErrorf("invalid_cursor", "cursor is invalid")
+	}
+	id, err := strconv.Atoi(string(raw))
+	if err != nil || id < 0 {
+		return 0, codedErrorf("invalid_cursor", "cursor is invalid")
+	}
+	return id, nil
+}
+
+// orders ?sort= accepts, a leading - reverses them
+var userSorts = map[string]func(a, b User) bool{
+	"id":         func(a, b User) bool { return a.ID < b.ID },
+	"name":       func(a, b User) bool { return a.Name < b.Name },
+	"email":      func(a, b User) bool { return a.Email < b.Email },
+	"created_at": func(a, b User) bool { return a.CreatedAt.Before(b.CreatedAt) },
+	"updated_at": func(a, b User) bool { return a.UpdatedAt.Before(b.UpdatedAt) },
+}
+
+// nil when the list can stay in the ascending id order the stores return
+func parseSort(key string) (func(a, b User) bool, error) {
+	if key == "" || key == "id" {
+		return nil, nil
+	}
+
+	desc := strings.HasPrefix(key, "-")
+	less, ok := userSorts[strings.TrimPrefix(key, "-")]
+	if !ok {
+		return nil, codedErrorf("invalid_sort", "sort must be id, name, email, created_at or updated_at, with a leading - for descending")
+	}
+	if desc {
+		return func(a, b User) bool { return less(b, a) }, nil
+	}
+	return less, nil
+}
+
+// ?include_deleted=, which only admins may set, to everyone else soft
+// deleted users are gone. writes a 400 or 403 itself and returns ok false
+// if the handler should stop
+func (s *Server) parseIncludeDeleted(w http.ResponseWriter, r *http.Request) (withDeleted, ok bool) {
+	withDeleted, err := parseBoolParam(r.URL.Query(), "include_deleted")
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return false, false
+	}
+	if withDeleted && !s.hasRole(r, roleAdmin) {
+		writeJSONError(
+			w,
+			http.StatusForbidden,
+			fmt.Sprintf("only the %s role may use include_deleted", roleAdmin),
+		)
+		return false, false
+	}
+	return withDeleted, true
+}
+
+// false when the parameter is missing, an error unless it's true or false
+func parseBoolParam(q url.Values, name string) (bool, error) {
+	if !q.Has(name) {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(q.Get(name))
+	if err != nil {
+		return false, codedErrorf("invalid_parameter", "%s must be true or false", name)
+	}
+	return v, nil
+}
+
+// reads ?limit= and ?offset= falling back to the defaults
+// limits above maxListLimit are clamped rather than rejected
+func parsePagination(q url.Values) (limit, offset int, err error) {
+	limit = defaultListLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, codedErrorf("invalid_limit", "limit must be a positive integer")
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, codedErrorf("invalid_offset", "offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// github style Link header for an offset page, every other query param kept as is
+// next and prev are left out on the last and first pages, prefix goes
+// in front of u's path
+func paginationLinks(prefix string, u *url.URL, limit, offset, total int) string {
+	link := func(offset int, rel string) string {
+		q := u.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(offset))
+		return fmt.Sprintf(`<%s%s?%s>; rel="%s"`, prefix, u.EscapedPath(), q.Encode(), rel)
+	}
+
+	last := 0
+	if total > 0 {
+		last = (total - 1) / limit * limit
+	}
+	links := []string{link(0, "first")}
+	if offset > 0 {
+		links = append(links, link(max(offset-limit, 0), "prev"))
+	}
+	// not offset+limit < total, that overflows for offsets near MaxInt
+	if offset < total-limit {
+		links = append(links, link(offset+limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+	return strings.Join(links, ", ")
+}
+
+// decodes the json request body into dst, capped at MaxBodyBytes
+// writes the error response itself and returns false if the handler should stop
+func (s *Server) decodeBody(
+	w http.ResponseWriter,
+	r *http.Request,
+	dst any,
+) bool {
+	return decodeBodyMax(w, r, dst, s.maxBodyBytes())
+}
+
+// decodeBody with a cap of its own, for bodies that can be much bigger than a user
+func decodeBodyMax(
+	w http.ResponseWriter,
+	r *http.Request,
+	dst any,
+	maxBytes int64,
+) bool {
+	if !requireContentType(w, r, "application/json") {
+		return false
+	}
+	return decodeJSON(w, r, dst, maxBytes)
+}
+
+// decodeBodyMax without the Content-Type check, for handlers that take
+// more than application/json and check it themselves
+func decodeJSON(
+	w http.ResponseWriter,
+	r *http.Request,
+	dst any,
+	maxBytes int64,
+) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	dec := json.NewDecoder(r.Body)
+	// a typo like {"naem": "bob"} should be an error, not a silently empty name
+	// the decoder's own message names the offending field so it goes back as is
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body must not exceed %d bytes", tooLarge.Limit),
+		)
+		return false
+	}
+	// the decoder's word for no body at all, or nothing but whitespace
+	if errors.Is(err, io.EOF) {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			codedErrorf("body_required", "request body is required"),
+		)
+		return false
+	}
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			codedErrorf("invalid_json", "%s", err),
+		)
+		return false
+	}
+
+	return true
+}
+
+// rejects bodies that aren't declared as one of the want media types with a 415
+// charset and other parameters are fine, e.g. application/json; charset=utf-8
+func requireContentType(
+	w http.ResponseWriter,
+	r *http.Request,
+	want ...string,
+) bool {
+	contentType := r.Header.Get("Content-Type")
+	// nothing to check when there's no body at all, decoding will report that
+	if contentType == "" && r.ContentLength == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !slices.Contains(want, mediaType) {
+		writeJSONError(
+			w,
+			http.StatusUnsupportedMediaType,
+			"Content-Type must be "+strings.Join(want, " or "),
+		)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) updateUser(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// If-Match carries the version the client last saw, 0 means not sent
+	expected, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// PUT replaces the whole user, so the body has to be a complete user
+	var replacement User
+	if !s.decodeBody(w, r, &replacement) {
+		return
+	}
+
+	if err := s.validateUser(&replacement); err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// the request timed out and the client already got a 503,
+	// don't make a change it will never hear about
+	if r.Context().Err() != nil {
+		return
+	}
+
+	// the store checks existence and writes under the same lock
+	// so a concurrent delete can't slip in between them
+	span := storeSpan(r.Context(), "Update", attribute.Int("user.id", id))
+	user, err := s.store(r.Context()).Update(r.Context(), id, func(user *User) error {
+		// compared under the store's lock so no other write can land in between
+		if expected != 0 && user.Version != expected {
+			return errVersionMismatch
+		}
+		*user = replacement
+		return nil
+	})
+	span.End()
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(
+			w,
+			http.StatusNotFound,
+			ErrUserNotFound,
+		)
+		return
+	}
+	if errors.Is(err, errVersionMismatch) {
+		writeError(
+			w,
+			http.StatusPreconditionFailed,
+			err,
+		)
+		return
+	}
+	if isConflict(err) {
+		writeError(
+			w,
+			http.StatusConflict,
+			err,
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r, userEvent{Type: eventUpdated, ID: user.ID, User: &user})
+
+	writeJSON(w, r, http.StatusOK, user)
+}
+
+func (s *Server) patchUser(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// If-Match carries the version the client last saw, 0 means not sent
+	expected, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// a merge patch, see applyUserPatch. decoded into a map so omitted
+	// fields stay untouched and an explicit null can be told apart from
+	// a missing key. plain json is taken as one too, as it always has been
+	if !requireContentType(w, r, "application/json", "application/merge-patch+json") {
+		return
+	}
+	var patch map[string]any
+	if !decodeJSON(w, r, &patch, s.maxBodyBytes()) {
+		return
+	}
+
+	// the request timed out and the client already got a 503,
+	// don't make a change it will never hear about
+	if r.Context().Err() != nil {
+		return
+	}
+
+	// read, patch and write back happen under one lock in the store
+	span := storeSpan(r.Context(), "Update", attribute.Int("user.id", id))
+	// kept apart so a patch that doesn't validate isn't mistaken for the store failing
+	var patchErr error
+	user, err := s.store(r.Context()).Update(r.Context(), id, func(user *User) error {
+		if expected != 0 && user.Version != expected {
+			return errVersionMismatch
+		}
+		fields, err := applyUserPatch(user, patch)
+		if err == nil && len(fields) > 0 {
+			// only what the patch touched, users from before emails were required have none
+			err = s.validateUser(user, fields...)
+		}
+		patchErr = err
+		return patchErr
+	})
+	span.End()
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(
+			w,
+			http.StatusNotFound,
+			ErrUserNotFound,
+		)
+		return
+	}
+	if errors.Is(err, errVersionMismatch) {
+		writeError(
+			w,
+			http.StatusPreconditionFailed,
+			err,
+		)
+		return
+	}
+	if isConflict(err) {
+		writeError(
+			w,
+			http.StatusConflict,
+			err,
+		)
+		return
+	}
+	if patchErr != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			patchErr,
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r, userEvent{Type: eventUpdated, ID: user.ID, User: &user})
+
+	writeJSON(w, r, http.StatusOK, user)
+}
+
+// returned from an update when If-Match names a version that's no longer current
+var errVersionMismatch = errors.New("user has been modified since the given version")
+
+// reads the expected version out of If-Match, accepting 3 or "3"
+// returns 0 when the header is absent or "*", which matches any version
+func parseIfMatch(header string) (int, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+	if err != nil || version < 1 {
+		return 0, codedErrorf("invalid_if_match", "If-Match must be a user version")
+	}
+	return version, nil
+}
+
+// true when the store refused a write because a unique field is taken
+func isConflict(err error) bool {
+	return errors.Is(err, ErrNameTaken) || errors.Is(err, ErrEmailTaken)
+}
+
+// checks user against the validate tags on User and normalizes the email
+// only the named struct fields are checked if there are any, all of them otherwise
+// the error is an *APIError with a message per json field, and the code
+// and message of the first one
+func (s *Server) validateUser(user *User, fields ...string) error {
+	// a patch that leaves the name alone doesn't tidy up an old one either,
+	// that could suddenly clash with someone else's
+	if len(fields) == 0 || slices.Contains(fields, "Name") {
+		user.Name = s.normalizeName(user.Name)
+	}
+	// mail.ParseAddress takes "Bob <bob@example.com>" too, which the email
+	// tag doesn't, so the address is taken out first
+	if email, err := normalizeEmail(user.Email); err == nil {
+		user.Email = email
+	}
+
+	var err error
+	if len(fields) > 0 {
+		err = s.validate.StructPartial(user, fields...)
+	} else {
+		err = s.validate.Struct(user)
+	}
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return err
+	}
+
+	apiErr := &APIError{Errors: map[string]string{}}
+	for _, fe := range fieldErrs {
+		// one message per field, the first rule it broke
+		if _, ok := apiErr.Errors[fe.Field()]; ok {
+			continue
+		}
+		msg := fieldMessage(fe)
+		apiErr.Errors[fe.Field()] = msg
+		if apiErr.Code == "" {
+			apiErr.Code = fieldCode(fe)
+			apiErr.Message = fe.Field() + " " + msg
+		}
+	}
+	return apiErr
+}
+
+// trims the spaces around name, and with CollapseNameSpaces turns any run
+// of them inside it into one, so "  Bob  Smith " is stored as "Bob Smith"
+func (s *Server) normalizeName(name string) string {
+	if s.CollapseNameSpaces {
+		return strings.Join(strings.Fields(name), " ")
+	}
+	return strings.TrimSpace(name)
+}
+
+// parses an email address and lowercases its host so that
+// Bob@Example.com and Bob@example.com are stored the same way
+func normalizeEmail(email string) (string, error) {
+	if email == "" {
+		return "", codedErrorf("email_required", "email is required")
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", codedErrorf("email_invalid", "email is not a valid address: %v", err)
+	}
+
+	// ParseAddress also accepts "Bob <bob@example.com>", only keep the address
+	at := strings.LastIndex(addr.Address, "@")
+	return addr.Address[:at] + "@" + strings.ToLower(addr.Address[at+1:]), nil
+}
+
+// the fields a PATCH may change, by json name. the zero ones are ignored,
+// they're managed by the server like on create, the others map to the
+// struct field they set
+var patchableFields = map[string]string{
+	"name":       "Name",
+	"email":      "Email",
+	"id":         "",
+	"version":    "",
+	"created_at": "",
+	"updated_at": "",
+	"deleted_at": "",
+}
+
+// applies patch to user as an RFC 7386 merge patch, by way of user's json:
+// a null clears the field and anything left out stays as it is. the caller
+// validates the result. returns the struct fields the patch names, for
+// Server.validateUser
+func applyUserPatch(user *User, patch map[string]any) ([]string, error) {
+	var fields []string
+	for field := range patch {
+		structField, ok := patchableFields[field]
+		if !ok {
+			return nil, codedErrorf("unknown_field", "unknown field %q", field)
+		}
+		if structField != "" {
+			fields = append(fields, structField)
+		}
+	}
+
+	current, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	var target any
+	if err := json.Unmarshal(current, &target); err != nil {
+		return nil, err
+	}
+	merged, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return nil, err
+	}
+
+	// from scratch, so a cleared field ends up empty rather than as it was
+	var patched User
+	if err := json.Unmarshal(merged, &patched); err != nil {
+		return nil, codedErrorf("invalid_json", "%s", err)
+	}
+	user.Name = patched.Name
+	user.Email = patched.Email
+	return fields, nil
+}
+
+// RFC 7386: patch's members replace target's, recursively for objects,
+// and null members remove them. a patch that isn't an object replaces
+// target as a whole
+func mergePatch(target, patch any) any {
+	members, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	result, ok := target.(map[string]any)
+	if !ok {
+		result = make(map[string]any)
+	}
+	for key, value := range members {
+		if value == nil {
+			delete(result, key)
+			continue
+		}
+		result[key] = mergePatch(result[key], value)
+	}
+	return result
+}
+
+func (s *Server) createUser(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	// declare empty user struct but don't initialize
+	// want to retrieve user data from http request
+	var user User
+	// decode information from the body to our user
+	if !s.decodeBody(w, r, &user) {
+		return
+	}
+
+	if err := s.validateUser(&user); err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+
+	// ?dry_run=true answers as if creating the user, without doing it
+	dryRun, err := parseBoolParam(r.URL.Query(), "dry_run")
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			err,
+		)
+		return
+	}
+	if dryRun {
+		s.checkCreateUser(w, r, user)
+		return
+	}
+
+	// a retry with the same key gets the first response instead of a second user
+	var created *User
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		entry := s.claimIdempotencyKey(w, r, key, user)
+		if entry == nil {
+			return
+		}
+		defer func() {
+			s.idempotency.finish(entry, created)
+		}()
+	}
+
+	// the request timed out and the client already got a 503,
+	// don't make a change it will never hear about
+	if r.Context().Err() != nil {
+		return
+	}
+
+	// adding user to the store under the next unused id
+	span := storeSpan(r.Context(), "Create")
+	user, err = s.store(r.Context()).Create(r.Context(), user)
+	if err == nil {
+		span.SetAttributes(attribute.Int("user.id", user.ID))
+	}
+	span.End()
+	if isConflict(err) {
+		writeError(
+			w,
+			http.StatusConflict,
+			err,
+		)
+		return
+	}
+	if errors.Is(err, ErrStoreFull) {
+		writeJSONError(
+			w,
+			http.StatusInsufficientStorage,
+			"user limit reached",
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	created = &user
+	s.publish(r, userEvent{Type: eventCreated, ID: user.ID, User: &user})
+
+	writeCreatedUser(w, r, user)
+}
+
+// the dry run of createUser: the same errors a real create would get,
+// or a 200 with {"valid": true} where it would have created the user
+func (s *Server) checkCreateUser(
+	w http.ResponseWriter,
+	r *http.Request,
+	user User,
+) {
+	span := storeSpan(r.Context(), "CheckCreate")
+	err := s.store(r.Context()).CheckCreate(r.Context(), user)
+	span.End()
+	if isConflict(err) {
+		writeError(
+			w,
+			http.StatusConflict,
+			err,
+		)
+		return
+	}
+	if errors.Is(err, ErrStoreFull) {
+		writeJSONError(
+			w,
+			http.StatusInsufficientStorage,
+			"user limit reached",
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]bool{"valid": true})
+}
+
+// send back the created user so the client learns its id
+func writeCreatedUser(w http.ResponseWriter, r *http.Request, user User) {
+	w.Header().Set("Location", fmt.Sprintf("%s%s/users/%d", pathPrefix(r.Context()), v1Prefix, user.ID))
+	writeJSON(w, r, http.StatusCreated, user)
+}
+
+// creates every user in a JSON array, or none of them if any is refused
+func (s *Server) createUsersBatch(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	var users []User
+	if !s.decodeBody(w, r, &users) {
+		return
+	}
+	if len(users) == 0 {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"batch must contain at least one user",
+		)
+		return
+	}
+
+	// validate them all so the client gets every problem in one go
+	// keyed by position in the array since new users have no id yet
+	invalid := map[string]string{}
+	for i := range users {
+		if err := s.validateUser(&users[i]); err != nil {
+			invalid[strconv.Itoa(i)] = err.Error()
+		}
+	}
+	if len(invalid) > 0 {
+		writeJSONErrors(
+			w,
+			http.StatusBadRequest,
+			"batch contains invalid users",
+			invalid,
+		)
+		return
+	}
+
+	if r.Context().Err() != nil {
+		return
+	}
+
+	span := storeSpan(r.Context(), "CreateMany", attribute.Int("users.count", len(users)))
+	created, err := s.store(r.Context()).CreateMany(r.Context(), users)
+	span.End()
+	var batchErr *BatchError
+	if isConflict(err) && errors.As(err, &batchErr) {
+		writeJSONErrors(
+			w,
+			http.StatusConflict,
+			"batch contains a name or email that is already taken",
+			map[string]string{strconv.Itoa(batchErr.Index): batchErr.Err.Error()},
+		)
+		return
+	}
+	if errors.Is(err, ErrStoreFull) && errors.As(err, &batchErr) {
+		writeJSONErrors(
+			w,
+			http.StatusInsufficientStorage,
+			"batch doesn't fit under the user limit",
+			map[string]string{strconv.Itoa(batchErr.Index): batchErr.Err.Error()},
+		)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	for i := range created {
+		s.publish(r, userEvent{Type: eventCreated, ID: created[i].ID, User: &created[i]})
+	}
+
+	writeJSON(w, r, http.StatusCreated, created)
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a server with a fresh memory store unless opts say otherwise, closed
+// when the test ends
+func newTestServer(t *testing.T, opts ...Option) *httptest.Server {
+	t.Helper()
+	opts = append([]Option{WithLogger(discardLogger())}, opts...)
+	ts := httptest.NewServer(NewServer(opts...).Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// sends body, if any, as json and returns the response with its body read
+func doRequest(t *testing.T, method, url, body string) (*http.Response, []byte) {
+	t.Helper()
+	return doRequestWithKey(t, method, url, body, "")
+}
+
+// doRequest with key in X-API-Key, if there is one
+func doRequestWithKey(t *testing.T, method, url, body, key string) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read %s %s: %v", method, url, err)
+	}
+	return resp, data
+}
+
+// creates a user through the API, failing the test unless it's a 201
+func createTestUser(t *testing.T, ts *httptest.Server, name, email string) User {
+	t.Helper()
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/v1/users", fmt.Sprintf(`{"name":%q,"email":%q}`, name, email))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create %q = %d %s", name, resp.StatusCode, body)
+	}
+	var user User
+	if err := json.Unmarshal(body, &user); err != nil {
+		t.Fatalf("decode created user: %v", err)
+	}
+	return user
+}
+
+// the users GET /v1/users returns for query
+func listTestUsers(t *testing.T, ts *httptest.Server, query string) []User {
+	t.Helper()
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/v1/users"+query, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list users = %d %s", resp.StatusCode, body)
+	}
+	var users []User
+	if err := json.Unmarshal(body, &users); err != nil {
+		t.Fatalf("decode users: %v", err)
+	}
+	return users
+}
+
+func TestDeleteAllUsers(t *testing.T) {
+	ts := newTestServer(t)
+	for i := 1; i <= 3; i++ {
+		createTestUser(t, ts, fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i))
+	}
+
+	resp, body := doRequest(t, http.MethodDelete, ts.URL+"/v1/users", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /v1/users = %d %s, want 204", resp.StatusCode, body)
+	}
+
+	if users := listTestUsers(t, ts, ""); len(users) != 0 {
+		t.Errorf("users after DELETE /v1/users = %v, want none", users)
+	}
+	// ids start from 1 again
+	if user := createTestUser(t, ts, "user1", "user1@example.com"); user.ID != 1 {
+		t.Errorf("first id after DELETE /v1/users = %d, want 1", user.ID)
+	}
+}
+
+func TestConcurrentDeletesOfOneUser(t *testing.T) {
+	for _, path := range []string{"/v1/users/1", "/v1/users/1?purge=true"} {
+		t.Run(path, func(t *testing.T) {
+			ts := newTestServer(t)
+			createTestUser(t, ts, "bob", "bob@example.com")
+
+			const deleters = 50
+			statuses := make(chan int, deleters)
+			var wg sync.WaitGroup
+			for range deleters {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					// not doRequest, Fatal mustn't be called off the test's goroutine
+					req, _ := http.NewRequest(http.MethodDelete, ts.URL+path, nil)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					resp.Body.Close()
+					statuses <- resp.StatusCode
+				}()
+			}
+			wg.Wait()
+			close(statuses)
+
+			counts := map[int]int{}
+			for status := range statuses {
+				counts[status]++
+			}
+			if counts[http.StatusNoContent] != 1 || counts[http.StatusNotFound] != deleters-1 {
+				t.Errorf("statuses = %v, want one 204 and %d 404s", counts, deleters-1)
+			}
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	ts := newTestServer(t)
+	resp, body := doRequest(t, http.MethodGet, ts.URL+"/version", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /version = %d %s", resp.StatusCode, body)
+	}
+	var info map[string]string
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatalf("decode version: %v", err)
+	}
+	for _, key := range []string{"version", "commit", "buildTime"} {
+		if info[key] == "" {
+			t.Errorf("GET /version = %s, missing %q", body, key)
+		}
+	}
+}
+
+func TestListUsersSortedPastTheEnd(t *testing.T) {
+	ts := newTestServer(t)
+	createTestUser(t, ts, "bob", "bob@example.com")
+	createTestUser(t, ts, "alice", "alice@example.com")
+
+	if users := listTestUsers(t, ts, "?sort=name&limit=1&offset=1"); len(users) != 1 || users[0].Name != "bob" {
+		t.Errorf("second page by name = %v, want bob", users)
+	}
+	// big enough that offset+limit overflows
+	if users := listTestUsers(t, ts, fmt.Sprintf("?sort=name&offset=%d", math.MaxInt)); len(users) != 0 {
+		t.Errorf("page past the end = %v, want none", users)
+	}
+}
+
+func TestPaginationLinks(t *testing.T) {
+	ts := newTestServer(t)
+	for i := 1; i <= 3; i++ {
+		createTestUser(t, ts, fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i))
+	}
+
+	resp, _ := doRequest(t, http.MethodGet, ts.URL+"/v1/users?limit=1&offset=1", "")
+	if link := resp.Header.Get("Link"); !strings.Contains(link, `offset=2>; rel="next"`) || !strings.Contains(link, `offset=0>; rel="prev"`) {
+		t.Errorf("Link for the second page = %q, want prev and next", link)
+	}
+	// big enough that offset+limit overflows
+	resp, _ = doRequest(t, http.MethodGet, fmt.Sprintf("%s/v1/users?limit=10&offset=%d", ts.URL, math.MaxInt), "")
+	if link := resp.Header.Get("Link"); strings.Contains(link, `rel="next"`) {
+		t.Errorf("Link for a page past the end = %q, want no next", link)
+	}
+}
+
+func TestIncludeDeletedIsForAdmins(t *testing.T) {
+	paths := []string{
+		"/v1/users?include_deleted=true",
+		"/v1/users/count?include_deleted=true",
+		"/v1/users?ids=1,2&include_deleted=true",
+	}
+
+	// without auth everyone counts as an admin
+	ts := newTestServer(t)
+	createTestUser(t, ts, "bob", "bob@example.com")
+	createTestUser(t, ts, "alice", "alice@example.com")
+	if resp, body := doRequest(t, http.MethodDelete, ts.URL+"/v1/users/1", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete 1 = %d %s", resp.StatusCode, body)
+	}
+	if users := listTestUsers(t, ts, "?include_deleted=true"); len(users) != 2 {
+		t.Errorf("users with deleted = %v, want both", users)
+	}
+
+	ts = newTestServer(t, WithAPIKeys("admin-key:admin", "user-key"))
+	for _, path := range paths {
+		for _, c := range []struct {
+			key  string
+			want int
+		}{
+			{"", http.StatusUnauthorized},
+			{"user-key", http.StatusForbidden},
+			{"admin-key", http.StatusOK},
+		} {
+			resp, body := doRequestWithKey(t, http.MethodGet, ts.URL+path, "", c.key)
+			if resp.StatusCode != c.want {
+				t.Errorf("GET %s with key %q = %d %s, want %d", path, c.key, resp.StatusCode, body, c.want)
+			}
+		}
+	}
+	// leaving them out is still up to anyone
+	if users := listTestUsers(t, ts, "?include_deleted=false"); len(users) != 0 {
+		t.Errorf("users without deleted = %v, want none", users)
+	}
+}
+
+func TestAuditLogIsForAdmins(t *testing.T) {
+	ts := newTestServer(t, WithAPIKeys("admin-key:admin", "user-key"))
+
+	for _, c := range []struct {
+		key  string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"user-key", http.StatusForbidden},
+		{"admin-key", http.StatusOK},
+	} {
+		resp, body := doRequestWithKey(t, http.MethodGet, ts.URL+"/v1/audit", "", c.key)
+		if resp.StatusCode != c.want {
+			t.Errorf("GET /v1/audit with key %q = %d %s, want %d", c.key, resp.StatusCode, body, c.want)
+		}
+	}
+}
+
+func TestAuditLogKeepsTheLatest(t *testing.T) {
+	ts := newTestServer(t, WithAuditSize(2))
+	for i := 1; i <= 3; i++ {
+		createTestUser(t, ts, fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i))
+	}
+
+	// entries reach the log through a background writer
+	var entries []auditEntry
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		_, body := doRequest(t, http.MethodGet, ts.URL+"/v1/audit", "")
+		entries = nil
+		if err := json.Unmarshal(body, &entries); err != nil {
+			t.Fatalf("decode audit log: %v", err)
+		}
+		if len(entries) > 0 && entries[len(entries)-1].Seq == 3 {
+			break
+		}
+	}
+	if len(entries) != 2 || entries[0].Seq != 2 || entries[1].UserID != 3 {
+		t.Errorf("audit log = %+v, want the entries for users 2 and 3", entries)
+	}
+}
+
+func TestCreatePastMaxUsers(t *testing.T) {
+	store := NewMemoryStore()
+	store.MaxUsers = 2
+	ts := newTestServer(t, WithStore(store))
+	createTestUser(t, ts, "bob", "bob@example.com")
+	createTestUser(t, ts, "alice", "alice@example.com")
+
+	// soft deleted users still count, purged ones don't
+	if resp, body := doRequest(t, http.MethodDelete, ts.URL+"/v1/users/1", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete 1 = %d %s", resp.StatusCode, body)
+	}
+	for _, c := range []struct{ path, body string }{
+		{"/v1/users", `{"name":"carol","email":"carol@example.com"}`},
+		{"/v1/users/batch", `[{"name":"carol","email":"carol@example.com"}]`},
+	} {
+		resp, body := doRequest(t, http.MethodPost, ts.URL+c.path, c.body)
+		var apiErr APIError
+		if err := json.Unmarshal(body, &apiErr); err != nil {
+			t.Fatalf("decode error body: %v", err)
+		}
+		if resp.StatusCode != http.StatusInsufficientStorage || apiErr.Code != "user_limit_reached" {
+			t.Errorf("POST %s past the limit = %d %s, want 507 user_limit_reached", c.path, resp.StatusCode, body)
+		}
+	}
+
+	if resp, body := doRequest(t, http.MethodDelete, ts.URL+"/v1/users/1?purge=true", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("purge 1 = %d %s", resp.StatusCode, body)
+	}
+	createTestUser(t, ts, "carol", "carol@example.com")
+
+	// expired users don't count either, even before anything sweeps them
+	store = NewMemoryStore()
+	store.MaxUsers = 1
+	store.TTL = 200 * time.Millisecond
+	ts = newTestServer(t, WithStore(store))
+	createTestUser(t, ts, "bob", "bob@example.com")
+	if resp, body := doRequest(t, http.MethodPost, ts.URL+"/v1/users", `{"name":"alice","email":"alice@example.com"}`); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("create next to a live user = %d %s, want 507", resp.StatusCode, body)
+	}
+	time.Sleep(store.TTL)
+	for _, c := range []struct {
+		path, body string
+		want       int
+	}{
+		{"/v1/users?dry_run=true", `{"name":"alice","email":"alice@example.com"}`, http.StatusOK},
+		{"/v1/users/batch", `[{"name":"alice","email":"alice@example.com"}]`, http.StatusCreated},
+	} {
+		if resp, body := doRequest(t, http.MethodPost, ts.URL+c.path, c.body); resp.StatusCode != c.want {
+			t.Errorf("POST %s next to an expired user = %d %s, want %d", c.path, resp.StatusCode, body, c.want)
+		}
+	}
+}
+
+// run with -race, creates, gets and deletes all going at the same few users
+func TestConcurrentMixedRequests(t *testing.T) {
+	ts := newTestServer(t)
+	const (
+		workers  = 20
+		requests = 50
+		// few enough names and ids that requests keep running into each
+		// other. purged names get created again under new ids, so there
+		// are more ids than names
+		names = 10
+		ids   = 3 * names
+	)
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range requests {
+				n, id := (w+i)%names, (w*7+i)%ids+1
+				var req *http.Request
+				switch i % 3 {
+				case 0:
+					req, _ = http.NewRequest(http.MethodPost, ts.URL+"/v1/users",
+						strings.NewReader(fmt.Sprintf(`{"name":"user%d","email":"user%d@example.com"}`, n, n)))
+					req.Header.Set("Content-Type", "application/json")
+				case 1:
+					req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/users/%d", ts.URL, id), nil)
+				case 2:
+					req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/v1/users/%d?purge=true", ts.URL, id), nil)
+				}
+				// not doRequest, Fatal mustn't be called off the test's goroutine
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				// a panic comes back from recover as a 500
+				if resp.StatusCode >= 500 {
+					t.Errorf("%s %s = %d", req.Method, req.URL, resp.StatusCode)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// whatever's left has to agree with itself
+	users := listTestUsers(t, ts, "?limit=100")
+	seen := map[string]bool{}
+	for _, user := range users {
+		if seen[user.Name] || seen[user.Email] {
+			t.Errorf("%q or %q listed twice", user.Name, user.Email)
+		}
+		seen[user.Name], seen[user.Email] = true, true
+		resp, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/v1/users/%d", ts.URL, user.ID), "")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET listed user %d = %d %s", user.ID, resp.StatusCode, body)
+		}
+	}
+	_, body := doRequest(t, http.MethodGet, ts.URL+"/v1/users/count", "")
+	var count struct{ Count int }
+	if err := json.Unmarshal(body, &count); err != nil {
+		t.Fatalf("decode count: %v", err)
+	}
+	if count.Count != len(users) {
+		t.Errorf("count = %d, list has %d users", count.Count, len(users))
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	store := NewMemoryStore()
+	store.MaxUsers = 2
+	ts := newTestServer(t, WithStore(store))
+	restore := func(users string) (*http.Response, []byte) {
+		t.Helper()
+		return doRequest(t, http.MethodPost, ts.URL+"/admin/restore", `{"last_id":3,"users":[`+users+`]}`)
+	}
+
+	// checked like a create, except that a missing email is fine
+	resp, body := restore(`{"id":1,"name":"  bob  ","email":"bob@example.com"},{"id":2,"name":"alice"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore = %d %s, want 200", resp.StatusCode, body)
+	}
+	if users := listTestUsers(t, ts, ""); len(users) != 2 || users[0].Name != "bob" {
+		t.Errorf("users after restore = %v, want bob's name trimmed", users)
+	}
+
+	resp, body = restore(fmt.Sprintf(`{"id":1,"name":%q,"email":"bob@example.com"}`, strings.Repeat("x", 101)))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("restore with a name too long = %d %s, want 400", resp.StatusCode, body)
+	}
+	resp, body = restore(`{"id":1,"name":"bob","email":"bob@example.com"},{"id":2,"name":" bob "}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("restore with names the same once trimmed = %d %s, want 400", resp.StatusCode, body)
+	}
+	resp, body = restore(`{"id":1,"name":"bob"},{"id":2,"name":"alice"},{"id":3,"name":"carol"}`)
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("restore past -max-users = %d %s, want 507", resp.StatusCode, body)
+	}
+	if users := listTestUsers(t, ts, ""); len(users) != 2 {
+		t.Errorf("users after failed restores = %v, want the first restore's", users)
+	}
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	server := NewServer(WithLogger(discardLogger()))
+	ts := httptest.NewServer(server.Handler())
+	t.Cleanup(ts.Close)
+	bob := createTestUser(t, ts, "bob", "bob@example.com")
+	bobURL := fmt.Sprintf("%s/v1/users/%d", ts.URL, bob.ID)
+	alice := `{"name":"alice","email":"alice@example.com"}`
+
+	server.SetReadOnly(true)
+	for _, c := range []struct {
+		method, url, body string
+	}{
+		{http.MethodPost, ts.URL + "/v1/users", alice},
+		{http.MethodPost, ts.URL + "/v1/users/batch", "[" + alice + "]"},
+		{http.MethodPut, bobURL, `{"name":"robert","email":"bob@example.com"}`},
+		{http.MethodPatch, bobURL, `{"name":"robert"}`},
+		{http.MethodDelete, bobURL, ""},
+		{http.MethodDelete, ts.URL + "/v1/users", ""},
+	} {
+		resp, body := doRequest(t, c.method, c.url, c.body)
+		var apiErr APIError
+		json.Unmarshal(body, &apiErr)
+		if resp.StatusCode != http.StatusServiceUnavailable || apiErr.Code != "read_only" || resp.Header.Get("Retry-After") != "60" {
+			t.Errorf("%s %s read-only = %d %s, Retry-After %q, want 503 read_only, 60",
+				c.method, c.url, resp.StatusCode, body, resp.Header.Get("Retry-After"))
+		}
+	}
+	for _, url := range []string{bobURL, ts.URL + "/v1/users", ts.URL + "/v1/users/count"} {
+		if resp, body := doRequest(t, http.MethodGet, url, ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s read-only = %d %s, want 200", url, resp.StatusCode, body)
+		}
+	}
+	// a dry run only checks, so it still gets its answer
+	if resp, body := doRequest(t, http.MethodPost, ts.URL+"/v1/users?dry_run=true", alice); resp.StatusCode != http.StatusOK {
+		t.Errorf("dry run create read-only = %d %s, want 200", resp.StatusCode, body)
+	}
+	if users := listTestUsers(t, ts, ""); len(users) != 1 {
+		t.Errorf("users after read-only writes = %v, want just bob", users)
+	}
+
+	// and back without a restart
+	server.SetReadOnly(false)
+	createTestUser(t, ts, "alice", "alice@example.com")
+}
+
+func TestTenantStoresOnlyOnWrites(t *testing.T) {
+	ts := newTestServer(t, WithTenants(false, nil), WithMaxTenants(2))
+	send := func(method, tenant, body string) (int, APIError) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+"/v1/users", strings.NewReader(body))
+		req.Header.Set(tenantHeader, tenant)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s for %s: %v", method, tenant, err)
+		}
+		defer resp.Body.Close()
+		var apiErr APIError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return resp.StatusCode, apiErr
+	}
+
+	// reads of made up tenants don't use up the cap
+	for i := range 5 {
+		if status, _ := send(http.MethodGet, fmt.Sprintf("reader%d", i), ""); status != http.StatusOK {
+			t.Errorf("GET for a new tenant = %d, want 200", status)
+		}
+	}
+	for _, tenant := range []string{"shop", "blog"} {
+		if status, _ := send(http.MethodPost, tenant, `{"name":"bob","email":"bob@example.com"}`); status != http.StatusCreated {
+			t.Errorf("first create for %s = %d, want 201", tenant, status)
+		}
+	}
+	if status, apiErr := send(http.MethodPost, "wiki", `{"name":"bob","email":"bob@example.com"}`); status != http.StatusInsufficientStorage || apiErr.Code != "tenant_limit_reached" {
+		t.Errorf("create for a third tenant = %d %q, want 507 tenant_limit_reached", status, apiErr.Code)
+	}
+	if status, _ := send(http.MethodPost, "shop", `{"name":"alice","email":"alice@example.com"}`); status != http.StatusCreated {
+		t.Errorf("create for a tenant that has a store = %d, want 201", status)
+	}
+}
+
+func TestNameWhitespace(t *testing.T) {
+	for _, c := range []struct {
+		name, stored string
+		collapse     bool
+	}{
+		{"  bob", "bob", false},
+		{"bob \t", "bob", false},
+		{" bob  smith ", "bob  smith", false},
+		{" bob  smith ", "bob smith", true},
+		{"bob\t\n smith", "bob smith", true},
+	} {
+		var opts []Option
+		if c.collapse {
+			opts = append(opts, WithCollapseNameSpaces())
+		}
+		ts := newTestServer(t, opts...)
+		if user := createTestUser(t, ts, c.name, "bob@example.com"); user.Name != c.stored {
+			t.Errorf("name %q stored as %q, want %q", c.name, user.Name, c.stored)
+		}
+		// the stored form is what has to be unique
+		resp, body := doRequest(t, http.MethodPost, ts.URL+"/v1/users", fmt.Sprintf(`{"name":%q,"email":"other@example.com"}`, " "+c.stored+" "))
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("create %q next to %q = %d %s, want 409", " "+c.stored+" ", c.name, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestNameCaseFolding(t *testing.T) {
+	store := NewMemoryStore()
+	store.FoldNameCase = true
+	ts := newTestServer(t, WithStore(store))
+	createTestUser(t, ts, "Bob", "bob@example.com")
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/v1/users", `{"name":" BOB ","email":"other@example.com"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("create BOB next to Bob = %d %s, want 409", resp.StatusCode, body)
+	}
+	// still stored as given
+	if users := listTestUsers(t, ts, ""); len(users) != 1 || users[0].Name != "Bob" {
+		t.Errorf("users = %v, want just Bob", users)
+	}
+
+	// without folding case matters
+	ts = newTestServer(t)
+	createTestUser(t, ts, "Bob", "bob@example.com")
+	createTestUser(t, ts, "bob", "other@example.com")
+}
+
+// a store whose Get waits for release, for requests that outlast a shutdown
+type blockingStore struct {
+	UserStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Get(ctx context.Context, id int) (User, error) {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.UserStore.Get(ctx, id)
+}
+
+func TestShutdownClosesSlowConnections(t *testing.T) {
+	store := &blockingStore{NewMemoryStore(), make(chan struct{}), make(chan struct{})}
+	defer close(store.release)
+	server := NewServer(WithLogger(discardLogger()), WithStore(store))
+	hs := server.HTTPServer("")
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go hs.Serve(ln)
+
+	clientErr := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/v1/users/1")
+		if err == nil {
+			resp.Body.Close()
+		}
+		clientErr <- err
+	}()
+	<-store.entered
+
+	start := time.Now()
+	dropped, err := server.Shutdown(hs, 100*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) || dropped != 1 {
+		t.Errorf("Shutdown = %d dropped, %v, want 1 and context.DeadlineExceeded", dropped, err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Shutdown took %s with a 100ms timeout", took)
+	}
+	select {
+	case err := <-clientErr:
+		if err == nil {
+			t.Error("slow request got a response, want its connection closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("slow request still open after Shutdown")
+	}
+}
+
+func TestJSONResponsesThroughWriteBody(t *testing.T) {
+	ts := newTestServer(t)
+	createTestUser(t, ts, "bob", "bob@example.com")
+
+	for _, path := range []string{"/v1/users/1", "/openapi.json", "/admin/snapshot", "/v1/users"} {
+		resp, body := doRequest(t, http.MethodGet, ts.URL+path, "")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" || !json.Valid(body) {
+			t.Errorf("GET %s = %d %q %.40s, want 200 with json", path, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+		// the client takes the length away when it undoes gzip
+		if !resp.Uncompressed && resp.ContentLength != int64(len(body)) {
+			t.Errorf("GET %s Content-Length = %d, body is %d bytes", path, resp.ContentLength, len(body))
+		}
+
+		head, headBody := doRequest(t, http.MethodHead, ts.URL+path, "")
+		if head.ContentLength != int64(len(body)) || len(headBody) != 0 {
+			t.Errorf("HEAD %s = length %d with %d bytes, want %d and none", path, head.ContentLength, len(headBody), len(body))
+		}
+	}
+
+	resp, _ := doRequest(t, http.MethodGet, ts.URL+"/admin/snapshot", "")
+	if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, "attachment") {
+		t.Errorf("snapshot Content-Disposition = %q, want an attachment", got)
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	ts := newTestServer(t)
+	bob := createTestUser(t, ts, "bob", "Bob@Example.com")
+	createTestUser(t, ts, "alice", "alice@example.com")
+
+	for _, c := range []struct {
+		email string
+		want  int
+	}{
+		{"Bob@example.com", http.StatusOK},
+		// hosts are compared ignoring case
+		{"Bob@EXAMPLE.COM", http.StatusOK},
+		{"carol@example.com", http.StatusNotFound},
+		{"not-an-email", http.StatusBadRequest},
+	} {
+		resp, body := doRequest(t, http.MethodGet, ts.URL+"/v1/users/by-email/"+c.email, "")
+		if resp.StatusCode != c.want {
+			t.Errorf("GET by email %s = %d %s, want %d", c.email, resp.StatusCode, body, c.want)
+			continue
+		}
+		var user User
+		if c.want == http.StatusOK && (json.Unmarshal(body, &user) != nil || user.ID != bob.ID) {
+			t.Errorf("GET by email %s = %s, want bob", c.email, body)
+		}
+	}
+
+	// soft deleted users aren't found either
+	if resp, body := doRequest(t, http.MethodDelete, ts.URL+"/v1/users/1", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete 1 = %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doRequest(t, http.MethodGet, ts.URL+"/v1/users/by-email/Bob@example.com", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET by email of a deleted user = %d %s, want 404", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long a retry with the same Idempotency-Key gets the first response back
+const idempotencyTTL = 24 * time.Hour
+
+// keys remembered at once, past this the oldest are forgotten early
+const maxIdempotencyKeys = 10000
+
+// longer keys are rejected rather than kept around for a day
+const maxIdempotencyKeyLen = 255
+
+// the key was used before for a different user
+var errIdempotencyMismatch = errors.New("Idempotency-Key was already used with a different body")
+
+// remembers which user each Idempotency-Key created
+// the zero value is ready to use
+type idempotencyKeys struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	// keys oldest first, they all live idempotencyTTL so the front expires first
+	order *list.List
+}
+
+type idempotencyEntry struct {
+	key string
+	// hash of the user that was asked for, a repeat must ask for the same one
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	elem        *list.Element
+
+	// closed when the request that claimed the key is done
+	// user is only safe to read after that, nil if nothing was created
+	done chan struct{}
+	user *User
+}
+
+// takes key for the caller, who must call finish once it's done. if another
+// request already has it, returns that request's entry and false instead
+func (k *idempotencyKeys) claim(key string, fingerprint [sha256.Size]byte) (*idempotencyEntry, bool, error) {
+	now := time.Now()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.entries == nil {
+		k.entries = make(map[string]*idempotencyEntry)
+		k.order = list.New()
+	}
+	for front := k.order.Front(); front != nil; front = k.order.Front() {
+		oldest := front.Value.(*idempotencyEntry)
+		if now.Before(oldest.expires) && k.order.Len() < maxIdempotencyKeys {
+			break
+		}
+		k.removeLocked(oldest)
+	}
+
+	if entry, ok := k.entries[key]; ok {
+		if entry.fingerprint != fingerprint {
+			return nil, false, errIdempotencyMismatch
+		}
+		return entry, false, nil
+	}
+
+	entry := &idempotencyEntry{
+		key:         key,
+		fingerprint: fingerprint,
+		expires:     now.Add(idempotencyTTL),
+		done:        make(chan struct{}),
+	}
+	entry.elem = k.order.PushBack(entry)
+	k.entries[key] = entry
+	return entry, true, nil
+}
+
+// records what the claiming request created and wakes up anyone waiting
+// with nil the key is let go, so a retry gets to try again
+func (k *idempotencyKeys) finish(entry *idempotencyEntry, user *User) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry.user = user
+	if user == nil {
+		k.removeLocked(entry)
+	}
+	close(entry.done)
+}
+
+func (k *idempotencyKeys) removeLocked(entry *idempotencyEntry) {
+	// it may have been evicted already and the key claimed again since
+	if k.entries[entry.key] == entry {
+		delete(k.entries, entry.key)
+		k.order.Remove(entry.elem)
+	}
+}
+
+// what a repeat of the request has to match, the user after validation
+// so that e.g. "Bob <bob@example.com>" still counts as the same body as the bare address
+func userFingerprint(user User) [sha256.Size]byte {
+	return sha256.Sum256([]byte(user.Name + "\x00" + user.Email))
+}
+
+// claims the request's Idempotency-Key for it to create user under
+// returns nil if the request has been answered already, with an error or
+// by replaying the response of the request that created the user first
+func (s *Server) claimIdempotencyKey(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+	user User,
+) *idempotencyEntry {
+	if len(key) > maxIdempotencyKeyLen {
+		writeJSONError(
+			w,
+			http.StatusBadRequest,
+			"Idempotency-Key is too long",
+		)
+		return nil
+	}
+
+	fingerprint := userFingerprint(user)
+	for {
+		// tenants can't see each other's responses by reusing a key
+		entry, first, err := s.idempotency.claim(tenantFromContext(r.Context())+"\x00"+key, fingerprint)
+		if err != nil {
+			writeError(
+				w,
+				http.StatusConflict,
+				err,
+			)
+			return nil
+		}
+		if first {
+			return entry
+		}
+
+		// the same request is still running, most likely a retry that came
+		// in too early, so wait for its answer
+		select {
+		case <-entry.done:
+		case <-r.Context().Done():
+			return nil
+		}
+		if entry.user != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeCreatedUser(w, r, *entry.user)
+			return nil
+		}
+		// it didn't create anything and let the key go, try claiming it again
+	}
+}
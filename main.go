@@ -1,162 +1,329 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"strconv"
-	"sync"
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-// making the map
-type User struct {
-	Name string `json:"name"`
-}
+func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		// nothing to log through yet, the standard logger will do
+		log.Fatal(err)
+	}
 
-// maps id to a user -- local table
-var userCache = make(map[int]User)
+	// Validate has already made sure these work. the level can change on SIGHUP
+	var level slog.LevelVar
+	lvl, _ := parseLevel(cfg.LogLevel)
+	level.Set(lvl)
+	logger, _ := newLogger(cfg.LogFormat, &level)
+	// the stores and anything else without a Server log through the default
+	slog.SetDefault(logger)
 
-// making the application thread safe
-// blocks all the reading and writing whenever the mutex gets locked
-// safe way to sync data in multi-threaded app
-var cacheMutex sync.RWMutex
+	if cfg.Pprof {
+		logger.Warn("pprof enabled under /debug/pprof/ and /debug/vars, don't expose this publicly", "addr", cfg.Addr)
+	}
+	if cfg.AuthUser == "" && len(cfg.APIKeys) == 0 && cfg.JWTSecret == "" {
+		logger.Warn("no -auth-user, -api-keys or -jwt-secret set, anyone can change users and use /admin")
+	}
 
-func main() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleRoot)
+	// cancelled on Ctrl-C or when the process manager asks us to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	mux.HandleFunc("POST /users", createUser)
-	mux.HandleFunc("GET /users/{id}", getUser)
-	mux.HandleFunc("DELETE /users/{id}", deleteUser)
+	var store UserStore
+	// only set for -store=memory, which is the one that needs saving on shutdown
+	var memStore *MemoryStore
+	// Validate already made sure it's one of these
+	switch cfg.Store {
+	case "memory":
+		memStore = NewMemoryStore()
+		// the index the file is loaded into depends on it
+		memStore.FoldNameCase = cfg.FoldNameCase
+		if cfg.DataFile != "" {
+			// a missing file just means this is the first run
+			err := memStore.LoadFromFile(cfg.DataFile)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				fatal("load data failed", "file", cfg.DataFile, "err", err)
+			}
+			if err == nil {
+				count, _ := memStore.Count(context.Background(), true)
+				logger.Info("loaded users", "count", count, "file", cfg.DataFile)
+			}
+		}
+		memStore.TTL = cfg.TTL
+		memStore.MaxEntries = cfg.MaxEntries
+		memStore.MaxUsers = cfg.MaxUsers
+		store = memStore
+	case "sqlite":
+		sqliteStore, err := NewSQLiteStore(cfg.DBPath)
+		if err != nil {
+			fatal("open database failed", "file", cfg.DBPath, "err", err)
+		}
+		defer sqliteStore.Close()
+		store = sqliteStore
+	case "redis":
+		redisStore, err := NewRedisStore(cfg.RedisAddr)
+		if err != nil {
+			fatal("connect to redis failed", "addr", cfg.RedisAddr, "err", err)
+		}
+		defer redisStore.Close()
+		store = redisStore
+	}
 
-	fmt.Println("server listening to :8080")
-	http.ListenAndServe(":8080", mux)
-}
+	// a no-op unless the standard OTEL_EXPORTER_OTLP_* variables are set
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("tracing setup failed", "err", err)
+	}
 
-func handleRoot(
-	w http.ResponseWriter,
-	r *http.Request,
-) {
-	fmt.Fprintf(w, "Hello World")
-}
+	opts := []Option{
+		WithStore(store),
+		WithLogger(logger),
+		WithTimeouts(Timeouts{
+			Request:    cfg.RequestTimeout,
+			ReadHeader: cfg.ReadHeaderTimeout,
+			Read:       cfg.ReadTimeout,
+			Write:      cfg.WriteTimeout,
+			Idle:       cfg.IdleTimeout,
+		}),
+		WithMaxConns(cfg.MaxConns),
+		WithAuditSize(cfg.AuditSize),
+		WithRateLimit(cfg.RateLimit, cfg.RateBurst),
+		WithAllowedOrigins(cfg.CORSOrigins...),
+		WithWebhooks(cfg.Webhooks...),
+		WithBasicAuth(cfg.AuthUser, cfg.AuthPassword),
+		WithAPIKeys(cfg.APIKeys...),
+		WithJWTSecret([]byte(cfg.JWTSecret)),
+	}
+	if cfg.TrustProxy {
+		opts = append(opts, WithTrustForwardedFor())
+	}
+	if cfg.CollapseNameSpaces {
+		opts = append(opts, WithCollapseNameSpaces())
+	}
+	if cfg.BasePath != "" {
+		opts = append(opts, WithBasePath(cfg.BasePath))
+	}
+	if cfg.Pprof {
+		opts = append(opts, WithPprof())
+	}
+	if cfg.Pretty {
+		opts = append(opts, WithPrettyJSON())
+	}
+	if cfg.Tenants {
+		// Validate has made sure it's the memory store, set up like the shared one
+		opts = append(opts, WithTenants(cfg.RequireTenant, func(string) UserStore {
+			tenantStore := NewMemoryStore()
+			tenantStore.TTL = cfg.TTL
+			tenantStore.MaxEntries = cfg.MaxEntries
+			tenantStore.MaxUsers = cfg.MaxUsers
+			tenantStore.FoldNameCase = cfg.FoldNameCase
+			return tenantStore
+		}), WithMaxTenants(cfg.MaxTenants))
+	}
+	server := NewServer(opts...)
+	server.SetReadOnly(cfg.ReadOnly)
+	// tenants aren't saved anywhere, so nothing waits for their sweep to stop
+	if cfg.Tenants && cfg.TTL > 0 {
+		go server.ExpireTenantsLoop(ctx, cfg.TTLSweep)
+	}
+
+	srv := server.HTTPServer(cfg.Addr)
+
+	go reloadOnHangup(ctx, cfg, server, &level)
+
+	// stops with ctx, main waits for it before saving
+	sweepDone := make(chan struct{})
+	if memStore != nil && cfg.TTL > 0 {
+		go func() {
+			defer close(sweepDone)
+			memStore.ExpireLoop(ctx, cfg.TTLSweep)
+		}()
+	} else {
+		close(sweepDone)
+	}
+	// the same, the final save mustn't race one of these
+	snapshotDone := make(chan struct{})
+	if memStore != nil && cfg.SnapshotInterval > 0 {
+		go func() {
+			defer close(snapshotDone)
+			memStore.SnapshotLoop(ctx, cfg.DataFile, cfg.SnapshotInterval)
+		}()
+	} else {
+		close(snapshotDone)
+	}
 
-func deleteUser(
-	w http.ResponseWriter,
-	r *http.Request,
-) {
-	id, err := strconv.Atoi(r.PathValue("id"))
+	ln, err := server.Listen(srv.Addr)
 	if err != nil {
-		http.Error(
-			w,
-			err.Error(),
-			http.StatusBadRequest,
-		)
-		return
-	}
-
-	// check if user even exists in database
-	if _, ok := userCache[id]; !ok {
-		http.Error(
-			w,
-			"user not found",
-			http.StatusNotFound,
-		)
-		return
-	}
-
-	cacheMutex.Lock()
-	// deletes key-value pair
-	delete(userCache, id)
-	cacheMutex.Unlock()
-
-	w.WriteHeader(http.StatusNoContent)
+		// e.g. the port is already in use
+		fatal("listen failed", "addr", srv.Addr, "err", err)
+	}
+
+	// serve in the background so main can wait for a signal
+	serverErr := make(chan error, 1)
+	go func() {
+		if cfg.TLSCert != "" {
+			logger.Info("server listening", "addr", srv.Addr, "scheme", "https")
+			serverErr <- srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+			return
+		}
+		logger.Info("server listening", "addr", srv.Addr, "scheme", "http")
+		serverErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serverErr:
+		// only returns this early if the server couldn't start, e.g. a bad certificate
+		fatal("server failed", "err", err)
+	case <-ctx.Done():
+	}
+	// a second Ctrl-C now kills the process straight away
+	stop()
+
+	// fail readiness while still serving, so load balancers move traffic
+	// elsewhere before connections start getting refused
+	server.Drain()
+	if cfg.DrainDelay > 0 {
+		logger.Info("draining", "delay", cfg.DrainDelay)
+		time.Sleep(cfg.DrainDelay)
+	}
+
+	logger.Info("shutting down")
+	// stop accepting connections and let in-flight handlers complete
+	if dropped, err := server.Shutdown(srv, cfg.ShutdownTimeout); err != nil {
+		logger.Error("shutdown timed out, closed connections", "timeout", cfg.ShutdownTimeout, "dropped", dropped, "err", err)
+	}
+
+	<-sweepDone
+	<-snapshotDone
+
+	// send off the last spans before we go, with a timeout of their own
+	// rather than what's left of an http shutdown that may have timed out
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancelTracing()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		logger.Error("tracing shutdown failed", "err", err)
+	}
+
+	// no handler is running anymore, so this captures the final state
+	if memStore != nil && cfg.DataFile != "" {
+		if err := memStore.SaveToFile(cfg.DataFile); err != nil {
+			logger.Error("save data failed", "file", cfg.DataFile, "err", err)
+		} else {
+			count, _ := memStore.Count(context.Background(), true)
+			logger.Info("saved users", "count", count, "file", cfg.DataFile)
+		}
+	}
 }
 
-func getUser(
-	w http.ResponseWriter,
-	r *http.Request,
-) {
-	// can get value of path parameter id
-	id, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil {
-		http.Error(
-			w,
-			err.Error(),
-			http.StatusBadRequest,
-		)
-		return
-	}
-
-	// locks reading
-	cacheMutex.RLock()
-	// retrieve user
-	user, ok := userCache[id]
-	// unlocks reading
-	cacheMutex.RUnlock()
-
-	// if user does not exist
-	if !ok {
-		http.Error(
-			w,
-			"user not found",
-			http.StatusNotFound,
-		)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	// want to return json representation of user
-	// error can occur while converting user struct to valid json representation
-	j, err := json.Marshal(user)
-	if err != nil {
-		http.Error(
-			w,
-			err.Error(),
-			http.StatusInternalServerError,
-		)
-		return
+// settings from the defaults, then the -config file, then the environment,
+// then the flags in args, each going over the ones before
+func loadConfig(args []string) (Config, error) {
+	// a first pass just to find the file, the flags go over it below
+	var path string
+	first := defaultConfig()
+	flags := first.flagSet(os.Args[0], flag.ExitOnError)
+	flags.StringVar(&path, "config", os.Getenv("CONFIG_FILE"), "YAML or JSON file with any of these settings, under the flag's name ($CONFIG_FILE)")
+	flags.Parse(args)
+
+	cfg := defaultConfig()
+	if path != "" {
+		var err error
+		if cfg, err = LoadConfig(path); err != nil {
+			return Config{}, err
+		}
 	}
+	cfg.applyEnv()
+
+	// only the flags actually given, the rest would put back their defaults
+	given := cfg.flagSet(os.Args[0], flag.ContinueOnError)
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && err == nil {
+			err = given.Set(f.Name, f.Value.String())
+		}
+	})
+	return cfg, err
+}
+
+// reads the settings again on every SIGHUP until ctx is done, putting the
+// reloadable ones into effect and warning about changes to the rest
+func reloadOnHangup(ctx context.Context, cfg Config, server *Server, level *slog.LevelVar) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
 
-	// writing the marshalled user to the response writer as a valid json representation
-	w.WriteHeader(http.StatusOK)
-	w.Write(j)
+		if cfg.File == "" {
+			slog.Warn("got SIGHUP but there's no -config file to reload")
+			continue
+		}
+		next, err := loadConfig(os.Args[1:])
+		if err == nil {
+			err = next.Validate()
+		}
+		if err != nil {
+			// a typo in the file shouldn't take down a running server
+			slog.Error("config reload failed, keeping the current settings", "file", cfg.File, "err", err)
+			continue
+		}
 
+		var ignored []string
+		for _, key := range cfg.changed(next) {
+			if !reloadableSettings[key] {
+				ignored = append(ignored, key)
+			}
+		}
+		if len(ignored) > 0 {
+			slog.Warn("config changes that need a restart were ignored", "settings", strings.Join(ignored, ","))
+		}
+
+		lvl, _ := parseLevel(next.LogLevel)
+		level.Set(lvl)
+		server.Reload(next.RateLimit, next.RateBurst, next.CORSOrigins)
+		server.SetReadOnly(next.ReadOnly)
+		// the ignored settings stay as they were, so they're still reported next time
+		cfg.LogLevel = next.LogLevel
+		cfg.RateLimit = next.RateLimit
+		cfg.RateBurst = next.RateBurst
+		cfg.CORSOrigins = next.CORSOrigins
+		cfg.ReadOnly = next.ReadOnly
+		slog.Info("config reloaded", "file", cfg.File)
+	}
 }
 
-func createUser(
-	w http.ResponseWriter,
-	r *http.Request,
-) {
-	// declare empty user struct but don't initialize
-	// want to retrieve user data from http request
-	var user User
-	// creates new decoder based on body in request
-	// decode information to our user
-	err := json.NewDecoder(r.Body).Decode(&user)
-	if err != nil {
-		http.Error(
-			w,
-			err.Error(),
-			http.StatusBadRequest,
-		)
-		return
-	}
-
-	if user.Name == "" {
-		http.Error(
-			w,
-			"name is required",
-			http.StatusBadRequest,
-		)
-		return
-	}
-
-	// locks mutex
-	cacheMutex.Lock()
-	// adding user to local database in the next available spot in cache
-	userCache[len(userCache)+1] = user
-	// unlocks RW access to userCache
-	cacheMutex.Unlock()
-
-	w.WriteHeader(http.StatusNoContent)
+// logs msg as an error and exits, for problems that stop us from starting
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// splits a comma-separated flag value, dropping blanks
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
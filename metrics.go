@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// request metrics for one Server, on their own registry so two servers
+// in the same process (tests) don't fight over the global one
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_total",
+				Help: "HTTP requests handled, by method, route and status code.",
+			},
+			[]string{"method", "path", "status"},
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_request_duration_seconds",
+				Help:    "Time taken to handle HTTP requests, by method and route.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"method", "path"},
+		),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		// the usual go_* and process_* series the global registry would have
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// serves the registry in the Prometheus text format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// counts and times every request under the route it matched in routes
+// st gets the count too, for /debug/vars
+func metricsMiddleware(m *metrics, st *serverStats, routes *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			start := time.Now()
+			rec := &statusRecorder{
+				ResponseWriter: w,
+				status:         http.StatusOK,
+			}
+
+			next.ServeHTTP(rec, r)
+			st.countRequest(rec.status)
+
+			path := routeLabel(routes, r)
+			m.requests.WithLabelValues(r.Method, path, strconv.Itoa(rec.status)).Inc()
+			m.duration.WithLabelValues(r.Method, path).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// the pattern a request matches, e.g. /users/{id} rather than /users/42,
+// so every user id doesn't become its own time series
+func routeLabel(routes *http.ServeMux, r *http.Request) string {
+	_, pattern := routes.Handler(r)
+	if pattern == "" {
+		// 405s and friends have no route, keep them in one bucket
+		return "unmatched"
+	}
+	// patterns look like "GET /users/{id}", the method is its own label
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Chain wraps h in middleware, the first one outermost: Chain(h, a, b)
+// is a(b(h)), so a request goes through a, then b, then reaches h.
+func Chain(h http.Handler, middleware ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// wraps a ResponseWriter to remember which status the handler sent
+type statusRecorder struct {
+	http.ResponseWriter
+	// 200 until the handler says otherwise, same as net/http
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	// only the first call counts, net/http ignores the rest
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// lets http.ResponseController reach the real writer underneath
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// context key for the logger loggingMiddleware was given
+type loggerKey struct{}
+
+// the logger loggingMiddleware put on the request, slog's default outside of one
+// for code that writes responses without a Server at hand, e.g. writeMarshalError
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// logs method, path, status and how long the request took, and puts logger
+// on the request for whatever inside logs about it
+func loggingMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			start := time.Now()
+			rec := &statusRecorder{
+				ResponseWriter: w,
+				status:         http.StatusOK,
+			}
+
+			ctx := context.WithValue(r.Context(), loggerKey{}, logger)
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.status),
+				slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.String("remote_addr", r.RemoteAddr),
+			}
+			// only there when requestIDMiddleware runs before us
+			if id := requestIDFromContext(r.Context()); id != "" {
+				attrs = append(attrs, slog.String("request_id", id))
+			}
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+		})
+	}
+}
+
+// turns a panicking handler into a 500 instead of killing the connection
+func recoverMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				// net/http uses this one on purpose to abort a response, let it through
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				logger.Error(
+					"panic serving request",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"request_id", requestIDFromContext(r.Context()),
+					"panic", err,
+					"stack", string(debug.Stack()),
+				)
+				writeJSONError(
+					w,
+					http.StatusInternalServerError,
+					"internal server error",
+				)
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routes whose responses stream for as long as the client listens
+// TimeoutHandler would buffer them and cut them off, so they skip it
+var untimedRoutes = map[string]bool{
+	"GET /v1/users/events": true,
+	// the unversioned alias, see deprecatedRoutes
+	"GET /users/events": true,
+	// these run for ?seconds=, pprof extends the write deadline to match itself
+	"GET /debug/pprof/profile": true,
+	"GET /debug/pprof/trace":   true,
+}
+
+// the 503 TimeoutHandler answers with. it's written as a fixed string
+// rather than through writeError, so it's marshalled once up front
+var timeoutBody = func() string {
+	body, _ := json.Marshal(APIError{
+		Code:    "request_timeout",
+		Message: "request timed out",
+		Status:  http.StatusServiceUnavailable,
+	})
+	return string(body)
+}()
+
+// cancels the request context after d and answers 503 if the handler
+// hasn't finished by then. anything the handler writes afterwards is dropped
+// requests for untimedRoutes in routes are passed straight through
+func timeoutMiddleware(d time.Duration, routes *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		timeout := http.TimeoutHandler(
+			next,
+			d,
+			timeoutBody,
+		)
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			if _, pattern := routes.Handler(r); untimedRoutes[pattern] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			timeout.ServeHTTP(&timeoutJSONWriter{ResponseWriter: w}, r)
+		})
+	}
+}
+
+// TimeoutHandler writes its 503 body without a Content-Type, so it would be
+// sniffed as text. handlers always set one, so a 503 without one is the timeout
+type timeoutJSONWriter struct {
+	http.ResponseWriter
+}
+
+func (tw *timeoutJSONWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && tw.Header().Get("Content-Type") == "" {
+		tw.Header().Set("Content-Type", "application/json")
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timeoutJSONWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// request headers browser apps may send, If-None-Match for conditional
+// GETs and If-Match for conditional writes
+var allowedHeaders = []string{"Content-Type", "Authorization", "X-API-Key", "Idempotency-Key", "If-None-Match", "If-Match", tenantHeader}
+
+// response headers browser apps may read, on top of the few every response
+// shows them. the ones clients need to page, cache, retry or follow a create
+var exposedHeaders = []string{"ETag", "Location", "X-Total-Count", "Link", "Retry-After", "X-Missing-Ids"}
+
+// lets browser apps on the origins from allowed call the API. "*" allows any origin
+// preflight requests are answered here and never reach the handlers
+// allowed is asked on every request, so the origins can change while serving
+func corsMiddleware(allowed func() []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			origin := r.Header.Get("Origin")
+			// same-origin and non-browser requests don't send an Origin
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			origins := allowed()
+			allowAny := slices.Contains(origins, "*")
+
+			h := w.Header()
+			if allowAny {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				// the answer depends on the Origin so caches must keep them apart
+				h.Add("Vary", "Origin")
+				if slices.Contains(origins, origin) {
+					h.Set("Access-Control-Allow-Origin", origin)
+				}
+			}
+
+			// a preflight is an OPTIONS asking whether the real method is allowed
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+				h.Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+				// browsers can skip the preflight for the next 10 minutes
+				h.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			h.Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
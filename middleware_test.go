@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a logger for tests that don't look at the log
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	// notes when a request comes in and when its response goes back out
+	marker := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name+" in")
+				next.ServeHTTP(w, r)
+				calls = append(calls, name+" out")
+			})
+		}
+	}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "handler")
+	}), marker("a"), marker("b"), marker("c"))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	want := []string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /panic", func(w http.ResponseWriter, r *http.Request) {
+		var users map[int]User
+		users[1] = User{}
+	})
+	mux.HandleFunc("GET /ok", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(Chain(mux, recoverMiddleware(discardLogger())))
+	defer ts.Close()
+
+	// twice, so the first panic didn't take anything down with it
+	for range 2 {
+		resp, err := http.Get(ts.URL + "/panic")
+		if err != nil {
+			t.Fatalf("GET /panic: %v", err)
+		}
+		var body APIError
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("decode error body: %v", err)
+		}
+		if resp.StatusCode != http.StatusInternalServerError || body.Code != "internal_error" {
+			t.Errorf("GET /panic = %d %q, want 500 internal_error", resp.StatusCode, body.Code)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/ok")
+	if err != nil {
+		t.Fatalf("GET /ok after a panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("GET /ok = %d, want 204", resp.StatusCode)
+	}
+}
+
+func TestMarshalErrorUsesRequestLogger(t *testing.T) {
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// json has no infinity
+		writeJSON(w, r, http.StatusOK, math.Inf(1))
+	}), loggingMiddleware(logger))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	if !strings.Contains(logs.String(), "marshal response failed") {
+		t.Errorf("log = %q, want the marshal failure in the server's logger", logs.String())
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	ts := httptest.NewServer(Chain(mux, timeoutMiddleware(10*time.Millisecond, mux)))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/slow")
+	if err != nil {
+		t.Fatalf("GET /slow: %v", err)
+	}
+	var body APIError
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Code != "request_timeout" {
+		t.Errorf("GET /slow = %d %q, want 503 request_timeout", resp.StatusCode, body.Code)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	ts := newTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/v1/users/1", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("preflight: %v", err)
+	}
+	resp.Body.Close()
+	allowed := resp.Header.Get("Access-Control-Allow-Headers")
+	for _, header := range []string{"Content-Type", "Authorization", "X-API-Key", "Idempotency-Key", "If-None-Match", "If-Match", "X-Tenant-ID"} {
+		if !slices.Contains(strings.Split(allowed, ", "), header) {
+			t.Errorf("Access-Control-Allow-Headers = %q, missing %s", allowed, header)
+		}
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/v1/users", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /v1/users: %v", err)
+	}
+	resp.Body.Close()
+	exposed := resp.Header.Get("Access-Control-Expose-Headers")
+	for _, header := range []string{"ETag", "Location", "X-Total-Count", "Link", "Retry-After", "X-Missing-Ids"} {
+		if !slices.Contains(strings.Split(exposed, ", "), header) {
+			t.Errorf("Access-Control-Expose-Headers = %q, missing %s", exposed, header)
+		}
+	}
+}
+
+func TestRateLimitCountsFailedAuth(t *testing.T) {
+	ts := newTestServer(t, WithRateLimit(1, 1), WithBasicAuth("admin", "secret"))
+
+	statuses := map[int]int{}
+	for range 50 {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/v1/users", strings.NewReader(`{"name":"bob","email":"bob@example.com"}`))
+		req.SetBasicAuth("admin", "wrong")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /v1/users: %v", err)
+		}
+		resp.Body.Close()
+		statuses[resp.StatusCode]++
+	}
+	if statuses[http.StatusTooManyRequests] == 0 {
+		t.Errorf("statuses for 50 wrong passwords = %v, want 429s", statuses)
+	}
+}
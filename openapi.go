@@ -0,0 +1,47 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// written by hand, so a route or status code added to the handlers
+// has to be added here as well
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func handleOpenAPI(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeBody(w, r, http.StatusOK, "application/json", openAPISpec)
+}
+
+// swagger ui comes from a cdn so the binary doesn't carry it
+// the spec's url is relative so it works under a base path too
+const docsPage = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GO-SERVER API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+func handleDocs(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(docsPage))
+}
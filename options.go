@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option sets one of a Server's fields for NewServer.
+type Option func(*Server)
+
+// NewServer returns a Server with opts applied in order. Anything they
+// leave alone has the same default as in a zero Server.
+func NewServer(opts ...Option) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithStore keeps users in store.
+func WithStore(store UserStore) Option {
+	return func(s *Server) {
+		s.Store = store
+	}
+}
+
+// WithTenants keeps each X-Tenant-ID's users in a store of their own from
+// newStore, see Tenants. Requests without the header get a 400 with required,
+// and use the store from WithStore otherwise.
+func WithTenants(required bool, newStore func(tenant string) UserStore) Option {
+	return func(s *Server) {
+		s.Tenants = true
+		s.RequireTenant = required
+		s.NewTenantStore = newStore
+	}
+}
+
+// WithMaxTenants caps how many tenants get a store of their own, see
+// MaxTenants.
+func WithMaxTenants(n int) Option {
+	return func(s *Server) {
+		s.MaxTenants = n
+	}
+}
+
+// WithCollapseNameSpaces stores "Bob  Smith" as "Bob Smith", see
+// CollapseNameSpaces.
+func WithCollapseNameSpaces() Option {
+	return func(s *Server) {
+		s.CollapseNameSpaces = true
+	}
+}
+
+// WithLogger sends the request log and errors to logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+// WithMaxBodyBytes caps request bodies at n bytes.
+func WithMaxBodyBytes(n int64) Option {
+	return func(s *Server) {
+		s.MaxBodyBytes = n
+	}
+}
+
+// Timeouts are the ones WithTimeouts sets, zero keeps that one's default.
+type Timeouts struct {
+	// how long a handler may run before the client gets a 503
+	Request time.Duration
+	// the http.Server's connection timeouts
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// WithTimeouts sets the request and connection timeouts.
+func WithTimeouts(t Timeouts) Option {
+	return func(s *Server) {
+		s.RequestTimeout = t.Request
+		s.ReadHeaderTimeout = t.ReadHeader
+		s.ReadTimeout = t.Read
+		s.WriteTimeout = t.Write
+		s.IdleTimeout = t.Idle
+	}
+}
+
+// WithAuditSize keeps the latest n changes for GET /audit.
+func WithAuditSize(n int) Option {
+	return func(s *Server) {
+		s.AuditSize = n
+	}
+}
+
+// WithMaxConns keeps at most n client connections open at once.
+func WithMaxConns(n int) Option {
+	return func(s *Server) {
+		s.MaxConns = n
+	}
+}
+
+// WithRateLimit allows each client ip perSecond requests a second and
+// bursts of up to burst, which is perSecond rounded up when zero.
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(s *Server) {
+		s.RateLimit = perSecond
+		s.RateBurst = burst
+	}
+}
+
+// WithBasePath serves everything under path, see BasePath.
+func WithBasePath(path string) Option {
+	return func(s *Server) {
+		s.BasePath = path
+	}
+}
+
+// WithTrustForwardedFor rate limits clients by X-Forwarded-For and builds
+// urls with X-Forwarded-Prefix, only safe behind a proxy that sets them.
+func WithTrustForwardedFor() Option {
+	return func(s *Server) {
+		s.TrustForwardedFor = true
+	}
+}
+
+// WithAllowedOrigins lets browser apps on origins call the API, "*" for any.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(s *Server) {
+		s.AllowedOrigins = origins
+	}
+}
+
+// WithPprof serves net/http/pprof under /debug/pprof/ and expvar at
+// /debug/vars, see EnablePprof.
+func WithPprof() Option {
+	return func(s *Server) {
+		s.EnablePprof = true
+	}
+}
+
+// WithPrettyJSON indents responses unless a request asks for ?pretty=false,
+// see PrettyJSON.
+func WithPrettyJSON() Option {
+	return func(s *Server) {
+		s.PrettyJSON = true
+	}
+}
+
+// WithWebhooks POSTs every change to a user to urls.
+func WithWebhooks(urls ...string) Option {
+	return func(s *Server) {
+		s.WebhookURLs = urls
+	}
+}
+
+// WithBasicAuth requires these HTTP Basic credentials for changes and /admin.
+func WithBasicAuth(username, password string) Option {
+	return func(s *Server) {
+		s.BasicAuthUser = username
+		s.BasicAuthPassword = password
+	}
+}
+
+// WithAPIKeys accepts any of keys in X-API-Key, see APIKeys.
+func WithAPIKeys(keys ...string) Option {
+	return func(s *Server) {
+		s.APIKeys = keys
+	}
+}
+
+// WithJWTSecret accepts bearer JWTs signed with secret.
+func WithJWTSecret(secret []byte) Option {
+	return func(s *Server) {
+		s.JWTSecret = secret
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Snapshot is the whole contents of a store: every user, sorted by id,
+// and the last id it handed out. It's the format of the -data file and
+// of GET /admin/snapshot.
+type Snapshot struct {
+	LastID int    `json:"last_id"`
+	Users  []User `json:"users"`
+}
+
+// Snapshotter is implemented by stores that can hand out and take back
+// everything they hold at once.
+type Snapshotter interface {
+	// a consistent copy of the store
+	Snapshot() (Snapshot, error)
+	// replaces everything in the store with snap, or on error changes nothing
+	LoadSnapshot(snap Snapshot) error
+}
+
+// Pinger is implemented by stores that depend on something that can be
+// down, e.g. a database. Ping returns nil when the store can serve.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// rejects snapshots no store could have written and fills in what older
+// ones leave out, so the stores can load the users as they are
+func (snap *Snapshot) check() error {
+	ids := make(map[int]bool, len(snap.Users))
+	names := make(map[string]bool, len(snap.Users))
+	emails := make(map[string]bool, len(snap.Users))
+	for i := range snap.Users {
+		user := &snap.Users[i]
+		if user.ID < 1 {
+			return fmt.Errorf("invalid user id %d", user.ID)
+		}
+		if ids[user.ID] {
+			return fmt.Errorf("duplicate user id %d", user.ID)
+		}
+		if names[user.Name] {
+			return fmt.Errorf("duplicate user name %q", user.Name)
+		}
+		// users from before emails existed all have none
+		if user.Email != "" && emails[user.Email] {
+			return fmt.Errorf("duplicate user email %q", user.Email)
+		}
+		ids[user.ID] = true
+		names[user.Name] = true
+		emails[user.Email] = true
+
+		// files saved before users had versions
+		if user.Version < 1 {
+			user.Version = 1
+		}
+		// never hand out an id that's already in the snapshot
+		if user.ID > snap.LastID {
+			snap.LastID = user.ID
+		}
+	}
+	return nil
+}
+
+// LoadFromFile replaces the store's contents with a file written by SaveToFile.
+// A missing file is returned as an fs.ErrNotExist error.
+func (s *MemoryStore) LoadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	if err := s.LoadSnapshot(snap); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *MemoryStore) LoadSnapshot(snap Snapshot) error {
+	if err := snap.check(); err != nil {
+		return err
+	}
+	// unlike MaxEntries nothing would make room again, so the whole
+	// snapshot is refused rather than cut short
+	if s.MaxUsers > 0 && len(snap.Users) > s.MaxUsers {
+		return fmt.Errorf("snapshot has %d users, more than the %d allowed: %w", len(snap.Users), s.MaxUsers, ErrStoreFull)
+	}
+
+	// build the new state in a fresh store before touching this one,
+	// so a bad snapshot changes nothing
+	loaded := NewMemoryStore()
+	loaded.FoldNameCase = s.FoldNameCase
+	for _, user := range snap.Users {
+		// check only knows about exact duplicates
+		if _, dup := loaded.nameIndex[loaded.nameKey(user.Name)]; dup {
+			return fmt.Errorf("duplicate user name %q ignoring case: %w", user.Name, ErrNameTaken)
+		}
+		loaded.shard(user.ID).users[user.ID] = user
+		loaded.countLocked(user, 1)
+		loaded.indexLocked(user)
+	}
+
+	s.mu.Lock()
+	s.lockShards()
+	s.nameIndex = loaded.nameIndex
+	s.emailIndex = loaded.emailIndex
+	s.userCount, s.deletedCount = loaded.userCount, loaded.deletedCount
+	s.lastID.Store(int64(snap.LastID))
+	for i := range s.shards {
+		s.shards[i].users = loaded.shards[i].users
+	}
+	s.unlockShards()
+
+	// the snapshot doesn't say who was used when, so later in it (higher ids,
+	// as Snapshot writes them) counts as more recent
+	s.lruMu.Lock()
+	s.lru = list.New()
+	s.lruElems = make(map[int]*list.Element)
+	if s.MaxEntries > 0 {
+		for _, user := range snap.Users {
+			s.lruElems[user.ID] = s.lru.PushFront(user.ID)
+		}
+	}
+	s.lruMu.Unlock()
+	// a snapshot taken with a bigger cap, or none
+	s.evictLocked()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// SaveToFile writes every user and the id counter to path.
+// The data goes to a temp file that's renamed over path, so a crash
+// mid-save leaves the previous file intact.
+func (s *MemoryStore) SaveToFile(path string) error {
+	snap, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the temp file has to live next to path for the rename to be atomic
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// harmless once the rename has happened
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// make sure the bytes are on disk before the rename makes them visible
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// calls SaveToFile every interval until ctx is done, so a crash loses at
+// most interval's worth of changes. the store is only locked while
+// Snapshot copies it, the write happens with the copy
+func (s *MemoryStore) SnapshotLoop(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.SaveToFile(path); err != nil {
+				slog.Error("snapshot failed", "file", path, "err", err)
+			} else {
+				slog.Debug("saved snapshot", "file", path)
+			}
+		}
+	}
+}
+
+// never fails, the error is there for stores that read from somewhere
+func (s *MemoryStore) Snapshot() (Snapshot, error) {
+	// only hold the locks long enough to copy, not while the caller writes it out
+	s.mu.RLock()
+	s.rlockShards()
+	snap := Snapshot{
+		LastID: int(s.lastID.Load()),
+		Users:  make([]User, 0, len(s.nameIndex)),
+	}
+	now := time.Now()
+	for i := range s.shards {
+		for _, user := range s.shards[i].users {
+			// they'd be gone the moment the snapshot was loaded anyway
+			if !s.expired(user, now) {
+				snap.Users = append(snap.Users, user)
+			}
+		}
+	}
+	s.runlockShards()
+	s.mu.RUnlock()
+
+	sort.Slice(snap.Users, func(i, j int) bool {
+		return snap.Users[i].ID < snap.Users[j].ID
+	})
+	return snap, nil
+}
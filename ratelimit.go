@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clients we haven't heard from for this long lose their bucket,
+// checked at most once per interval so the map can't grow forever
+const (
+	limiterIdleTTL       = 3 * time.Minute
+	limiterSweepInterval = time.Minute
+)
+
+// a token bucket per client ip
+type rateLimiter struct {
+	// the requests per second and burst to allow, asked on every request so
+	// they can change while serving. a limit of zero or less lets everything through
+	settings func() (perSecond float64, burst int)
+	// use the address our proxy reports instead of the connection's
+	trustForwardedFor bool
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(settings func() (float64, int), trustForwardedFor bool) *rateLimiter {
+	return &rateLimiter{
+		settings:          settings,
+		trustForwardedFor: trustForwardedFor,
+		clients:           make(map[string]*clientLimiter),
+		lastSweep:         time.Now(),
+	}
+}
+
+// takes a token for the client, or reports how long until one is available
+func (rl *rateLimiter) allow(client string) (bool, time.Duration) {
+	perSecond, burst := rl.settings()
+	if perSecond <= 0 {
+		return true, 0
+	}
+	limit := rate.Limit(perSecond)
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > limiterSweepInterval {
+		for key, c := range rl.clients {
+			if now.Sub(c.lastSeen) > limiterIdleTTL {
+				delete(rl.clients, key)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	c, ok := rl.clients[client]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(limit, burst)}
+		rl.clients[client] = c
+	}
+	c.lastSeen = now
+	// the settings were reloaded since, the tokens already in the bucket carry over
+	if c.limiter.Limit() != limit || c.limiter.Burst() != burst {
+		c.limiter.SetLimitAt(now, limit)
+		c.limiter.SetBurstAt(now, burst)
+	}
+
+	// a reservation tells us the wait, which becomes Retry-After
+	res := c.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		// we're rejecting, so give the token back
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// the key a request is rate limited under
+func (rl *rateLimiter) clientIP(r *http.Request) string {
+	if rl.trustForwardedFor {
+		// the last hop is the one our own proxy appended, anything before it
+		// came from the client and could be made up
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			hops := strings.Split(xff, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// answers 429 with Retry-After once a client runs out of tokens
+func rateLimitMiddleware(rl *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			ok, retryAfter := rl.allow(rl.clientIP(r))
+			if !ok {
+				// Retry-After is whole seconds, round up so clients don't come back early
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				writeJSONError(
+					w,
+					http.StatusTooManyRequests,
+					"rate limit exceeded",
+				)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what read-only answers tell clients to wait, maintenance rarely takes less
+const readOnlyRetryAfter = time.Minute
+
+// SetReadOnly turns read-only mode on or off, for maintenance. Writes get
+// a 503 until it's turned off again, reads keep working. Safe to call while
+// serving, e.g. on SIGHUP.
+func (s *Server) SetReadOnly(readOnly bool) {
+	if s.readOnly.Swap(readOnly) == readOnly {
+		return
+	}
+	if readOnly {
+		s.logger().Warn("read-only mode on, rejecting writes")
+	} else {
+		s.logger().Warn("read-only mode off, accepting writes again")
+	}
+}
+
+// wraps every route in routes that can change something to answer 503
+// in read-only mode. GET and HEAD only read, they're left as they are,
+// and so is POST /users?dry_run=true, which only checks the user
+func (s *Server) readOnlyRoutes(routes []apiRoute) []apiRoute {
+	wrapped := make([]apiRoute, len(routes))
+	for i, route := range routes {
+		wrapped[i] = route
+		method, path, _ := strings.Cut(route.pattern, " ")
+		switch {
+		case method == http.MethodGet:
+		case method == http.MethodPost && path == "/users":
+			wrapped[i].handler = s.rejectInReadOnlyUnlessDryRun(route.handler)
+		default:
+			wrapped[i].handler = s.rejectInReadOnly(route.handler)
+		}
+	}
+	return wrapped
+}
+
+// rejectInReadOnly for creates, except for dry runs. only createUser looks
+// at dry_run, other routes would write despite it, so this is just for that
+func (s *Server) rejectInReadOnlyUnlessDryRun(next http.HandlerFunc) http.HandlerFunc {
+	reject := s.rejectInReadOnly(next)
+	return func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		if dryRun, err := parseBoolParam(r.URL.Query(), "dry_run"); err == nil && dryRun {
+			next(w, r)
+			return
+		}
+		reject(w, r)
+	}
+}
+
+func (s *Server) rejectInReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		// one atomic load, so writes cost nothing extra while it's off
+		if s.readOnly.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(readOnlyRetryAfter.Seconds())))
+			writeError(
+				w,
+				http.StatusServiceUnavailable,
+				codedErrorf("read_only", "the server is read-only for maintenance, try again later"),
+			)
+			return
+		}
+		next(w, r)
+	}
+}
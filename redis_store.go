@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// every user is a hash under user:{id}, the rest of the keys are indexes
+// kept up to date by the scripts below, never written any other way
+const (
+	// INCR'd for every new id, like lastID in MemoryStore
+	redisSeqKey = "users:seq"
+	// name -> id and email -> id, for uniqueness, GetByName and GetByEmail
+	redisNamesKey  = "users:names"
+	redisEmailsKey = "users:emails"
+	// sorted sets of ids scored by id, so ranges come out in id order
+	// live leaves soft deleted users out
+	redisAllKey  = "users:all"
+	redisLiveKey = "users:live"
+)
+
+// how many times modify reads and tries to save a user before it gives up
+// on one somebody else keeps writing
+const redisMaxAttempts = 10
+
+func redisUserKey(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+// the scripts run atomically on the server, which is what makes the
+// uniqueness checks hold with any number of instances writing at once.
+// refusals come back as error replies, see redisErr
+
+// KEYS names, emails, seq, all, live
+// ARGV now, then a name and an email per user
+var redisCreateScript = redis.NewScript(`
+local n = (#ARGV - 1) / 2
+local names, emails = {}, {}
+for i = 1, n do
+	local name, email = ARGV[2 * i], ARGV[2 * i + 1]
+	if names[name] or redis.call('HEXISTS', KEYS[1], name) == 1 then
+		return redis.error_reply('TAKEN name ' .. (i - 1))
+	end
+	if email ~= '' and (emails[email] or redis.call('HEXISTS', KEYS[2], email) == 1) then
+		return redis.error_reply('TAKEN email ' .. (i - 1))
+	end
+	names[name] = true
+	emails[email] = true
+end
+local ids = {}
+for i = 1, n do
+	local name, email = ARGV[2 * i], ARGV[2 * i + 1]
+	local id = redis.call('INCR', KEYS[3])
+	redis.call('HSET', 'user:' .. id, 'name', name, 'email', email, 'version', 1,
+		'created_at', ARGV[1], 'updated_at', ARGV[1], 'deleted_at', '')
+	redis.call('HSET', KEYS[1], name, id)
+	if email ~= '' then
+		redis.call('HSET', KEYS[2], email, id)
+	end
+	redis.call('ZADD', KEYS[4], id, id)
+	redis.call('ZADD', KEYS[5], id, id)
+	ids[i] = id
+end
+return ids`)
+
+// overwrites a user read at version, unless it has moved on since
+// KEYS names, emails, live
+// ARGV id, version, name, email, updated_at, deleted_at
+var redisSaveScript = redis.NewScript(`
+local key = 'user:' .. ARGV[1]
+local current = redis.call('HMGET', key, 'version', 'name', 'email')
+if not current[1] then
+	return redis.error_reply('NOTFOUND')
+end
+if current[1] ~= ARGV[2] then
+	return redis.error_reply('CONFLICT')
+end
+local name, email = ARGV[3], ARGV[4]
+local owner = redis.call('HGET', KEYS[1], name)
+if owner and owner ~= ARGV[1] then
+	return redis.error_reply('TAKEN name 0')
+end
+if email ~= '' then
+	owner = redis.call('HGET', KEYS[2], email)
+	if owner and owner ~= ARGV[1] then
+		return redis.error_reply('TAKEN email 0')
+	end
+end
+redis.call('HDEL', KEYS[1], current[2])
+if current[3] ~= '' then
+	redis.call('HDEL', KEYS[2], current[3])
+end
+redis.call('HSET', KEYS[1], name, ARGV[1])
+if email ~= '' then
+	redis.call('HSET', KEYS[2], email, ARGV[1])
+end
+local version = tonumber(ARGV[2]) + 1
+redis.call('HSET', key, 'name', name, 'email', email, 'version', version,
+	'updated_at', ARGV[5], 'deleted_at', ARGV[6])
+if ARGV[6] == '' then
+	redis.call('ZADD', KEYS[3], ARGV[1], ARGV[1])
+else
+	redis.call('ZREM', KEYS[3], ARGV[1])
+end
+return version`)
+
+// KEYS names, emails, all, live
+// ARGV id
+var redisDeleteScript = redis.NewScript(`
+local key = 'user:' .. ARGV[1]
+local current = redis.call('HMGET', key, 'name', 'email')
+if not current[1] then
+	return 0
+end
+redis.call('DEL', key)
+redis.call('HDEL', KEYS[1], current[1])
+if current[2] ~= '' then
+	redis.call('HDEL', KEYS[2], current[2])
+end
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+return 1`)
+
+// KEYS names, emails, seq, all, live
+var redisDeleteAllScript = redis.NewScript(`
+for _, id in ipairs(redis.call('ZRANGE', KEYS[4], 0, -1)) do
+	redis.call('DEL', 'user:' .. id)
+end
+redis.call('DEL', unpack(KEYS))
+return 1`)
+
+// returned by redisSaveScript when someone else wrote the user first
+var errRedisConflict = errors.New("user changed while saving")
+
+// RedisStore keeps users in Redis, so several instances of the server can
+// share them.
+//
+// Reads are plain commands. Writes go through Lua scripts, which Redis
+// runs one at a time, so the indexes and the users never disagree.
+// Updates read the user, change it here and save it only if its version
+// hasn't moved, starting over if it has.
+type RedisStore struct {
+	rdb *redis.Client
+}
+
+// NewRedisStore connects to the Redis server at addr, failing if it
+// doesn't answer a PING.
+func NewRedisStore(addr string) (*RedisStore, error) {
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, err
+	}
+	return &RedisStore{rdb: rdb}, nil
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.rdb.Ping(ctx).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.rdb.Close()
+}
+
+func (s *RedisStore) Create(ctx context.Context, user User) (User, error) {
+	created, err := s.CreateMany(ctx, []User{user})
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		// a batch of one, the index means nothing to the caller
+		return User{}, batchErr.Err
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return created[0], nil
+}
+
+func (s *RedisStore) CreateMany(ctx context.Context, users []User) ([]User, error) {
+	if len(users) == 0 {
+		return []User{}, nil
+	}
+
+	now := time.Now().UTC()
+	args := []any{formatTime(now)}
+	for _, user := range users {
+		args = append(args, user.Name, user.Email)
+	}
+	ids, err := redisCreateScript.Run(
+		ctx,
+		s.rdb,
+		[]string{redisNamesKey, redisEmailsKey, redisSeqKey, redisAllKey, redisLiveKey},
+		args...,
+	).Int64Slice()
+	if err != nil {
+		return nil, redisErr(err)
+	}
+
+	created := make([]User, len(users))
+	for i, user := range users {
+		user.ID = int(ids[i])
+		user.Version = 1
+		user.CreatedAt = now
+		user.UpdatedAt = now
+		user.DeletedAt = nil
+		created[i] = user
+	}
+	return created, nil
+}
+
+func (s *RedisStore) CheckCreate(ctx context.Context, user User) error {
+	// the same lookups the create script starts with, soft deleted users included
+	nameTaken, err := s.rdb.HExists(ctx, redisNamesKey, user.Name).Result()
+	if err != nil {
+		return err
+	}
+	if nameTaken {
+		return ErrNameTaken
+	}
+	if user.Email == "" {
+		return nil
+	}
+	emailTaken, err := s.rdb.HExists(ctx, redisEmailsKey, user.Email).Result()
+	if err != nil {
+		return err
+	}
+	if emailTaken {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+func (s *RedisStore) Get(ctx context.Context, id int) (User, error) {
+	fields, err := s.rdb.HGetAll(ctx, redisUserKey(id)).Result()
+	if err != nil {
+		return User{}, err
+	}
+	if len(fields) == 0 {
+		return User{}, ErrUserNotFound
+	}
+	return parseRedisUser(id, fields)
+}
+
+// the users among ids that exist, in order, fetched in one round trip
+func (s *RedisStore) GetMany(ctx context.Context, ids []int) ([]User, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, redisUserKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		user, err := parseRedisUser(ids[i], fields)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s *RedisStore) GetByName(ctx context.Context, name string) (User, error) {
+	id, err := s.rdb.HGet(ctx, redisNamesKey, name).Int()
+	if errors.Is(err, redis.Nil) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return s.Get(ctx, id)
+}
+
+func (s *RedisStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	if email == "" {
+		return User{}, ErrUserNotFound
+	}
+	id, err := s.rdb.HGet(ctx, redisEmailsKey, email).Int()
+	if errors.Is(err, redis.Nil) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return s.Get(ctx, id)
+}
+
+func (s *RedisStore) Update(ctx context.Context, id int, fn func(user *User) error) (User, error) {
+	// fn runs again if the user changes before the save, so it sees the latest
+	return s.modify(ctx, id, func(user *User, now time.Time) error {
+		if user.DeletedAt != nil {
+			return ErrUserNotFound
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+		user.DeletedAt = nil
+		return nil
+	})
+}
+
+func (s *RedisStore) SoftDelete(ctx context.Context, id int) (User, error) {
+	return s.modify(ctx, id, func(user *User, now time.Time) error {
+		if user.DeletedAt != nil {
+			return ErrUserNotFound
+		}
+		// the name and email stay indexed, so nobody can take them in the meantime
+		user.DeletedAt = &now
+		return nil
+	})
+}
+
+func (s *RedisStore) Restore(ctx context.Context, id int) (User, error) {
+	return s.modify(ctx, id, func(user *User, now time.Time) error {
+		if user.DeletedAt == nil {
+			return ErrNotDeleted
+		}
+		user.DeletedAt = nil
+		return nil
+	})
+}
+
+// reads the user, lets change work out its new state and saves that if
+// nobody wrote the user in between, starting over from the read if they did.
+// after redisMaxAttempts lost races it returns ErrWriteConflict
+// the id, version and timestamps other than DeletedAt aren't change's to set
+func (s *RedisStore) modify(ctx context.Context, id int, change func(user *User, now time.Time) error) (User, error) {
+	for attempt := 0; attempt < redisMaxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return User{}, err
+		}
+		current, err := s.Get(ctx, id)
+		if err != nil {
+			return User{}, err
+		}
+
+		now := time.Now().UTC()
+		user := current
+		if err := change(&user, now); err != nil {
+			return User{}, err
+		}
+		user.ID = id
+		user.Version = current.Version + 1
+		user.CreatedAt = current.CreatedAt
+		user.UpdatedAt = now
+
+		deletedAt := ""
+		if user.DeletedAt != nil {
+			deletedAt = formatTime(*user.DeletedAt)
+		}
+		err = redisSaveScript.Run(
+			ctx,
+			s.rdb,
+			[]string{redisNamesKey, redisEmailsKey, redisLiveKey},
+			id,
+			current.Version,
+			user.Name,
+			user.Email,
+			formatTime(now),
+			deletedAt,
+		).Err()
+		err = redisErr(err)
+		if errors.Is(err, errRedisConflict) {
+			continue
+		}
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			return User{}, batchErr.Err
+		}
+		if err != nil {
+			return User{}, err
+		}
+		return user, nil
+	}
+	return User{}, ErrWriteConflict
+}
+
+func (s *RedisStore) Delete(ctx context.Context, id int) error {
+	n, err := redisDeleteScript.Run(
+		ctx,
+		s.rdb,
+		[]string{redisNamesKey, redisEmailsKey, redisAllKey, redisLiveKey},
+		id,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *RedisStore) DeleteAll(ctx context.Context) error {
+	return redisDeleteAllScript.Run(
+		ctx,
+		s.rdb,
+		[]string{redisNamesKey, redisEmailsKey, redisSeqKey, redisAllKey, redisLiveKey},
+	).Err()
+}
+
+// the sorted set of ids List and friends read from
+func redisIDsKey(withDeleted bool) string {
+	if withDeleted {
+		return redisAllKey
+	}
+	return redisLiveKey
+}
+
+func (s *RedisStore) List(ctx context.Context, limit, offset int, withDeleted bool) ([]User, error) {
+	ids, err := s.rdb.ZRange(ctx, redisIDsKey(withDeleted), int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.usersByID(ctx, ids)
+}
+
+func (s *RedisStore) ListAfter(ctx context.Context, after, limit int, withDeleted bool) ([]User, error) {
+	ids, err := s.rdb.ZRangeByScore(ctx, redisIDsKey(withDeleted), &redis.ZRangeBy{
+		Min:   "(" + strconv.Itoa(after),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.usersByID(ctx, ids)
+}
+
+// redis has nothing like a substring index, so this reads every user
+func (s *RedisStore) Search(ctx context.Context, query string, limit, offset int, withDeleted bool) ([]User, int, error) {
+	ids, err := s.rdb.ZRange(ctx, redisIDsKey(withDeleted), 0, -1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	all, err := s.usersByID(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = strings.ToLower(query)
+	users := []User{}
+	total := 0
+	for _, user := range all {
+		if !strings.Contains(strings.ToLower(user.Name), query) &&
+			!strings.Contains(strings.ToLower(user.Email), query) {
+			continue
+		}
+		if total >= offset && len(users) < limit {
+			users = append(users, user)
+		}
+		total++
+	}
+	return users, total, nil
+}
+
+// fetches the users for ids as read out of a sorted set
+// a user deleted in between is just left out
+func (s *RedisStore) usersByID(ctx context.Context, members []string) ([]User, error) {
+	ids := make([]int, len(members))
+	for i, member := range members {
+		id, err := strconv.Atoi(member)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return s.GetMany(ctx, ids)
+}
+
+func (s *RedisStore) Count(ctx context.Context, withDeleted bool) (int, error) {
+	n, err := s.rdb.ZCard(ctx, redisIDsKey(withDeleted)).Result()
+	return int(n), err
+}
+
+// turns the scripts' error replies into the store's errors
+func redisErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	// some servers, miniredis among them, put ERR in front of one word replies
+	msg := strings.TrimPrefix(err.Error(), "ERR ")
+	switch {
+	case msg == "NOTFOUND":
+		return ErrUserNotFound
+	case msg == "CONFLICT":
+		return errRedisConflict
+	case strings.HasPrefix(msg, "TAKEN "):
+		var field string
+		var index int
+		if _, scanErr := fmt.Sscanf(msg, "TAKEN %s %d", &field, &index); scanErr != nil {
+			return err
+		}
+		taken := ErrNameTaken
+		if field == "email" {
+			taken = ErrEmailTaken
+		}
+		return &BatchError{Index: index, Err: taken}
+	}
+	return err
+}
+
+// reads a user hash as the scripts write it
+func parseRedisUser(id int, fields map[string]string) (User, error) {
+	user := User{
+		ID:    id,
+		Name:  fields["name"],
+		Email: fields["email"],
+	}
+
+	var err error
+	if user.Version, err = strconv.Atoi(fields["version"]); err != nil {
+		return User{}, err
+	}
+	if user.CreatedAt, err = time.Parse(time.RFC3339Nano, fields["created_at"]); err != nil {
+		return User{}, err
+	}
+	if user.UpdatedAt, err = time.Parse(time.RFC3339Nano, fields["updated_at"]); err != nil {
+		return User{}, err
+	}
+	if v := fields["deleted_at"]; v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return User{}, err
+		}
+		user.DeletedAt = &t
+	}
+	return user, nil
+}
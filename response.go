@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// APIError is the body of every error response, so clients can always
+// json-decode one and switch on Code rather than match Message. The codes
+// are listed in the README and never change meaning once released.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+	Status  int    `json:"status"`
+	// per-item messages for requests that carry more than one thing,
+	// keyed by the item's position, e.g. {"2": "name is required"}
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// an error that tells writeError its code, the status comes from the caller
+func codedErrorf(code, format string, args ...any) error {
+	return &APIError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// the code for errors that don't come with their own, by status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "authentication_required",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusNotAcceptable:         "not_acceptable",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusInsufficientStorage:   "user_limit_reached",
+}
+
+// the codes of the store's and handlers' sentinel errors
+var sentinelCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrUserNotFound, "user_not_found"},
+	{ErrNameTaken, "name_taken"},
+	{ErrEmailTaken, "email_taken"},
+	{ErrNotDeleted, "not_deleted"},
+	{ErrStoreFull, "user_limit_reached"},
+	{ErrWriteConflict, "write_conflict"},
+	{errVersionMismatch, "version_mismatch"},
+	{errIdempotencyMismatch, "idempotency_key_reused"},
+}
+
+// the code err is answered with under status
+func errorCode(err error, status int) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code != "" {
+		return apiErr.Code
+	}
+	for _, sentinel := range sentinelCodes {
+		if errors.Is(err, sentinel.err) {
+			return sentinel.code
+		}
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return "error"
+}
+
+// like http.Error but writes an APIError, with the code for status
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSONErrors(w, status, msg, nil)
+}
+
+// writeJSONError with an "errors" map alongside the message
+func writeJSONErrors(w http.ResponseWriter, status int, msg string, errs map[string]string) {
+	writeAPIError(w, &APIError{
+		Code:    errorCode(nil, status),
+		Message: msg,
+		Status:  status,
+		Errors:  errs,
+	})
+}
+
+// writeJSONError with err's message, under its code when it has one
+func writeError(w http.ResponseWriter, status int, err error) {
+	e := &APIError{
+		Code:    errorCode(err, status),
+		Message: err.Error(),
+		Status:  status,
+	}
+	// per-field messages from validation come along too
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		e.Errors = apiErr.Errors
+	}
+	writeAPIError(w, e)
+}
+
+func writeAPIError(w http.ResponseWriter, e *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	// keeps browsers from sniffing the error into something else
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// what writeNegotiated can answer in, the first one when the client doesn't care
+var offeredTypes = []string{"application/json", "application/xml", "text/xml"}
+
+// picks the offeredTypes entry r's Accept header rates highest
+// writes a 406 itself and returns false if it accepts none of them
+func negotiateContentType(w http.ResponseWriter, r *http.Request) (string, bool) {
+	// the body depends on Accept, so caches must keep the versions apart
+	w.Header().Add("Vary", "Accept")
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offeredTypes[0], true
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offeredTypes {
+		// a strictly higher quality wins, so ties go to the earlier offer
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if best == "" {
+		writeJSONError(
+			w,
+			http.StatusNotAcceptable,
+			"can only respond with "+strings.Join(offeredTypes, ", "),
+		)
+		return "", false
+	}
+	return best, true
+}
+
+// how much accept wants contentType, from 0 for not at all to 1
+// the most specific matching range counts, so "*/*, text/xml;q=0" rules out text/xml
+func acceptQuality(accept, contentType string) float64 {
+	typ, _, _ := strings.Cut(contentType, "/")
+
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		var s int
+		switch mediaRange {
+		case contentType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+
+		rangeQ := 1.0
+		if v, ok := params["q"]; ok {
+			if rangeQ, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		q, specificity = rangeQ, s
+	}
+	return q
+}
+
+// context key for whether r's responses are indented, see prettyMiddleware
+type prettyKey struct{}
+
+// settles once per request whether its body is indented: ?pretty= when
+// it has one, def otherwise
+func prettyMiddleware(def bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			pretty := def
+			if r.URL.Query().Has("pretty") {
+				var err error
+				if pretty, err = parseBoolParam(r.URL.Query(), "pretty"); err != nil {
+					writeError(
+						w,
+						http.StatusBadRequest,
+						err,
+					)
+					return
+				}
+			}
+			ctx := context.WithValue(r.Context(), prettyKey{}, pretty)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// v as json, indented by two spaces if r asked for it
+func marshalJSON(r *http.Request, v any) ([]byte, error) {
+	if pretty, _ := r.Context().Value(prettyKey{}).(bool); pretty {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+// v as contentType, one of offeredTypes, indented like marshalJSON
+func marshalAs(r *http.Request, contentType string, v any) ([]byte, error) {
+	if contentType == "application/json" {
+		return marshalJSON(r, v)
+	}
+	var body []byte
+	var err error
+	if pretty, _ := r.Context().Value(prettyKey{}).(bool); pretty {
+		body, err = xml.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = xml.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// writes v as json with status, indented if r asked for it. the headers
+// go out before WriteHeader, so handlers set only their extra ones first
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	body, err := marshalJSON(r, v)
+	if err != nil {
+		writeMarshalError(w, r, err)
+		return
+	}
+
+	writeBody(w, r, status, "application/json", body)
+}
+
+// writes body, already marshalled as contentType, with status. HEAD gets
+// the same status and headers, the length of the body included, without
+// the body itself
+func writeBody(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// a 500 for a response body that didn't marshal, logged since it's our bug
+// nothing has been written yet, so the client still gets a proper error
+func writeMarshalError(w http.ResponseWriter, r *http.Request, err error) {
+	loggerFromContext(r.Context()).Error("marshal response failed", "request_id", requestIDFromContext(r.Context()), "err", err)
+	writeJSONError(
+		w,
+		http.StatusInternalServerError,
+		"internal server error",
+	)
+}
+
+// writes v as json or xml, whichever the client's Accept header prefers
+// handlers that need the body first, e.g. for an ETag, use
+// negotiateContentType and marshalAs themselves and then writeBody
+func writeNegotiated(w http.ResponseWriter, r *http.Request, status int, v any) {
+	contentType, ok := negotiateContentType(w, r)
+	if !ok {
+		return
+	}
+	body, err := marshalAs(r, contentType, v)
+	if err != nil {
+		writeMarshalError(w, r, err)
+		return
+	}
+	writeBody(w, r, status, contentType, body)
+}
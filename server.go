@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/net/netutil"
+)
+
+// 1 MiB is far more than a user needs and stops clients streaming gigabytes at us
+const defaultMaxBodyBytes = 1 << 20
+
+// generous for an in-memory lookup, mostly there for slow database backends
+const defaultRequestTimeout = 10 * time.Second
+
+// connection timeouts for the http.Server, the zero values in net/http
+// mean "wait forever" which lets slowloris clients hold connections open
+const (
+	// a client gets 5s to send its headers, the usual slowloris vector
+	defaultReadHeaderTimeout = 5 * time.Second
+	// headers plus body, bodies are capped at MaxBodyBytes anyway
+	defaultReadTimeout = 15 * time.Second
+	// longer than defaultRequestTimeout so the 503 still makes it out
+	defaultWriteTimeout = 15 * time.Second
+	// how long an idle keep-alive connection stays open
+	defaultIdleTimeout = 60 * time.Second
+	// how long in-flight requests get to finish on shutdown, main's default
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// Server holds everything the handlers share, so each instance
+// (one in main, a fresh one per test) gets its own state.
+type Server struct {
+	// where users are kept, a fresh NewMemoryStore() when nil
+	Store UserStore
+
+	// scope users by the X-Tenant-ID header, each tenant getting a store of
+	// its own from NewTenantStore. requests without the header use Store,
+	// or get a 400 with RequireTenant
+	Tenants       bool
+	RequireTenant bool
+	// makes a tenant's store on its first write, NewMemoryStore when nil
+	NewTenantStore func(tenant string) UserStore
+	// the most tenants with a store at once, a write for one more gets a
+	// 507. zero means no limit
+	MaxTenants int
+	tenants    tenantStores
+
+	// gets the request log and anything that goes wrong, slog.Default() when nil
+	Logger *slog.Logger
+
+	// cap on request bodies, defaultMaxBodyBytes when zero
+	MaxBodyBytes int64
+
+	// requests running longer get a 503, defaultRequestTimeout when zero
+	RequestTimeout time.Duration
+
+	// requests per second allowed from one client ip, zero disables limiting
+	RateLimit float64
+	// how many requests a client may make in a quick burst, RateLimit when zero
+	RateBurst int
+	// set RateLimit, RateBurst and AllowedOrigins with Reload once serving
+	// key clients by X-Forwarded-For and put X-Forwarded-Prefix in front
+	// of the urls we send, only safe behind a proxy that sets them
+	TrustForwardedFor bool
+
+	// serve everything under this path, e.g. "/api" for /api/v1/users,
+	// for a proxy that passes its prefix on. "" serves from the root
+	BasePath string
+
+	// browser origins allowed to call the API, "*" for any
+	// nil allows any origin, an empty non-nil slice allows none
+	AllowedOrigins []string
+
+	// guards the settings Reload changes
+	settingsMu sync.RWMutex
+
+	// rejects every write with a 503 while set, see SetReadOnly
+	readOnly atomic.Bool
+
+	// turn runs of whitespace inside names into one space, names are always
+	// trimmed. only new and changed names are, stored ones stay as they are
+	CollapseNameSpaces bool
+
+	// shared by every request, it caches what it learns about User's tags
+	validate *validator.Validate
+
+	// passed on to the http.Server, the matching default when zero
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// the most client connections Listen has open at once, zero for no
+	// limit. more wait to be accepted until one closes
+	MaxConns int
+
+	// serve net/http/pprof under /debug/pprof/ and expvar at /debug/vars.
+	// anyone who can reach them can read the heap and stall the server with
+	// long profiles, so only turn this on where the port isn't public
+	EnablePprof bool
+
+	// indent json and xml responses for reading by hand, requests can
+	// still ask either way with ?pretty=
+	PrettyJSON bool
+
+	// urls that get a POST for every change to a user, delivered in the background
+	WebhookURLs []string
+
+	// when both are set, changes and the admin endpoints need these as
+	// HTTP Basic credentials, reading users stays open to anyone
+	BasicAuthUser     string
+	BasicAuthPassword string
+	// the same as BasicAuthUser for X-API-Key headers, any of these keys
+	// will do. with both set a request may use either
+	// "key:admin" gives the key the admin role, which deletes need
+	APIKeys []string
+	// the same again for bearer JWTs signed with this HMAC secret, their
+	// role claim being the role
+	JWTSecret []byte
+
+	// open GET /users/events streams
+	events eventBus
+
+	// Idempotency-Key values POST /users has seen and the users they created
+	idempotency idempotencyKeys
+
+	// how many changes GET /audit keeps, the oldest go once there are more.
+	// defaultAuditSize when zero
+	AuditSize int
+
+	// the latest changes made through the API, for GET /audit
+	audit auditLog
+
+	// in-flight requests and connections, for /metrics
+	stats serverStats
+
+	// set by Drain, /readyz answers 503 from then on
+	draining atomic.Bool
+
+	// started on the first change, from WebhookURLs
+	webhooksOnce sync.Once
+	webhooks     *webhookNotifier
+}
+
+// HTTPServer returns an http.Server listening on addr with the
+// server's handler and connection timeouts.
+func (s *Server) HTTPServer(addr string) *http.Server {
+	hs := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: orDefault(s.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       orDefault(s.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      orDefault(s.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       orDefault(s.IdleTimeout, defaultIdleTimeout),
+		// net/http's own complaints, e.g. failed TLS handshakes
+		ErrorLog:  slog.NewLogLogger(s.logger().Handler(), slog.LevelWarn),
+		ConnState: s.stats.connState,
+	}
+	// event streams never finish on their own, Shutdown would wait them out
+	hs.RegisterOnShutdown(s.events.close)
+	return hs
+}
+
+// Listen opens the listener for the http.Server from HTTPServer to
+// Serve on, holding back connections past MaxConns.
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.MaxConns > 0 {
+		// the ones over the limit queue in the kernel's backlog, a
+		// client whose connect times out there sees a refusal
+		ln = netutil.LimitListener(ln, s.MaxConns)
+	}
+	return ln, nil
+}
+
+// Drain makes /readyz answer 503 from now on, so load balancers stop
+// sending requests before the http.Server is shut down. Everything else
+// keeps serving as before.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// Shutdown stops hs, the http.Server from HTTPServer, giving in-flight
+// requests up to timeout to finish. Any connections still open after that
+// are closed, and Shutdown returns how many there were along with the
+// error from hs.Shutdown.
+func (s *Server) Shutdown(hs *http.Server, timeout time.Duration) (dropped int64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		// a handler is stuck, or a client holds on to a slow response.
+		// cut them off rather than never exiting
+		dropped = s.stats.openConns.Load()
+		hs.Close()
+		return dropped, err
+	}
+	return 0, nil
+}
+
+// Handler returns the routes wrapped in the server's middleware,
+// ready to use as an http.Server's Handler or with httptest.NewServer.
+func (s *Server) Handler() http.Handler {
+	// so a zero Server works too
+	if s.Store == nil {
+		s.Store = NewMemoryStore()
+	}
+	s.validate = newValidator()
+	s.audit.size = s.AuditSize
+	m := newMetrics()
+	m.registry.MustRegister(s.stats.collectors()...)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", fallbackHandler(mux))
+	// {$} so it's only the root itself, "/" alone would match every path
+	mux.HandleFunc("GET /{$}", handleRoot)
+	mux.HandleFunc("GET /healthz", handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("GET /openapi.json", handleOpenAPI)
+	mux.HandleFunc("GET /docs", handleDocs)
+	mux.Handle("GET /metrics", m.handler())
+
+	if s.EnablePprof {
+		mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+		mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+		mux.Handle("GET /debug/vars", s.varsHandler())
+	}
+
+	// anyone can read or replace every user through these, so only
+	// serve them publicly with BasicAuthUser, APIKeys or JWTSecret set.
+	// they're for admins too, a restore deletes as much as DELETE /users
+	admin := s.requireRole(roleAdmin)
+	// tenants snapshot and restore their own users
+	mux.HandleFunc("GET /admin/snapshot", admin(s.withTenant(s.getSnapshot)))
+	mux.HandleFunc("POST /admin/restore", admin(s.withTenant(s.rejectInReadOnly(s.restoreSnapshot))))
+
+	routes := s.readOnlyRoutes(s.tenantRoutes(s.v1Routes()))
+	mountRoutes(mux, v1Prefix, routes)
+	// the paths from before versioning keep working for now, marked
+	// deprecated and pointing at their /v1 equivalent
+	mountRoutes(mux, "", deprecatedRoutes(routes, v1Prefix))
+
+	// outermost first, see Chain
+	// request ids go on first so every log line, the request's own included, can have one
+	// the base path comes off after logging, so the log has the path the client asked for
+	// metrics sees every status including 429s and 503s, before compression
+	// in-flight counts from metrics inwards, that's where a request's time is measured
+	// gzip goes outside recover so the 500 for a panic is compressed like anything else
+	// recover sits inside logging so recovered panics get logged as 500s
+	// cors goes outside timeout, rate limiting and auth so those responses still have its headers
+	// rate limiting goes outside auth, so wrong passwords count against the limit like any other request
+	// timeout sits inside recover because TimeoutHandler re-panics on its own goroutine
+	// pretty only changes how handlers write their bodies, anywhere inside the mux's callers would do
+	// tracing wraps just the mux so handler spans hang off the request's span
+	middleware := []func(http.Handler) http.Handler{
+		requestIDMiddleware,
+		loggingMiddleware(s.logger()),
+		basePathMiddleware(s.BasePath, s.TrustForwardedFor),
+		metricsMiddleware(m, &s.stats, mux),
+		inFlightMiddleware(&s.stats),
+		gzipMiddleware,
+		recoverMiddleware(s.logger()),
+		corsMiddleware(s.allowedOrigins),
+		// always there, even with no RateLimit yet, in case Reload sets one
+		rateLimitMiddleware(newRateLimiter(s.rateSettings, s.TrustForwardedFor)),
+	}
+	if auths, challenges := s.authenticators(); len(auths) > 0 {
+		middleware = append(middleware, authMiddleware(challenges, auths...))
+	}
+	middleware = append(middleware,
+		timeoutMiddleware(s.requestTimeout(), mux),
+		prettyMiddleware(s.PrettyJSON),
+		tracingMiddleware(mux),
+	)
+	return Chain(mux, middleware...)
+}
+
+// where v1 of the API lives, e.g. GET /v1/users/1
+const v1Prefix = "/v1"
+
+// a route of a versioned API, pattern is relative to the version's prefix
+type apiRoute struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// v1 of the API. a breaking change goes into a v2Routes mounted under /v2
+// next to these, so clients of v1 keep getting what they expect
+func (s *Server) v1Routes() []apiRoute {
+	admin := s.requireRole(roleAdmin)
+	return []apiRoute{
+		{"POST /users", s.createUser},
+		{"POST /users/batch", s.createUsersBatch},
+		{"POST /users/import", s.importCSV},
+		{"GET /users", s.listUsers},
+		{"GET /users/count", s.countUsers},
+		{"GET /users.csv", s.exportCSV},
+		{"GET /users/events", s.streamEvents},
+		// also HEAD /users/{id}, GET patterns match HEAD as well. spelling it
+		// out would clash with the GET routes next to it, e.g. /users/count
+		{"GET /users/{id}", s.getUser},
+		{"GET /users/by-name/{name}", s.getUserByName},
+		{"GET /users/by-email/{email}", s.getUserByEmail},
+		{"PUT /users/{id}", s.updateUser},
+		{"PATCH /users/{id}", s.patchUser},
+		{"DELETE /users/{id}", admin(s.deleteUser)},
+		{"POST /users/{id}/restore", s.restoreUser},
+		{"DELETE /users", admin(s.deleteAllUsers)},
+		{"GET /audit", admin(s.listAudit)},
+	}
+}
+
+// registers routes under prefix, so "GET /users" becomes "GET /v1/users"
+// the routes stay on the one mux rather than a StripPrefix'd one, which
+// keeps the full pattern visible to the middleware that looks it up
+func mountRoutes(mux *http.ServeMux, prefix string, routes []apiRoute) {
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route.pattern, " ")
+		mux.HandleFunc(method+" "+prefix+path, route.handler)
+	}
+}
+
+// wraps routes to tell clients they're on their way out and where
+// the same route lives under successor, the prefix replacing them
+func deprecatedRoutes(routes []apiRoute, successor string) []apiRoute {
+	wrapped := make([]apiRoute, len(routes))
+	for i, route := range routes {
+		next := route.handler
+		wrapped[i] = apiRoute{route.pattern, func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s%s>; rel="successor-version"`, pathPrefix(r.Context()), successor, r.URL.EscapedPath()))
+			next(w, r)
+		}}
+	}
+	return wrapped
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+func (s *Server) maxBodyBytes() int64 {
+	if s.MaxBodyBytes > 0 {
+		return s.MaxBodyBytes
+	}
+	return defaultMaxBodyBytes
+}
+
+func (s *Server) requestTimeout() time.Duration {
+	return orDefault(s.RequestTimeout, defaultRequestTimeout)
+}
+
+// Reload changes the rate limit and allowed origins of a server that's
+// already serving, for requests from then on. The other fields are only
+// read when the handler is built, changing them later does nothing.
+func (s *Server) Reload(rateLimit float64, rateBurst int, allowedOrigins []string) {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	s.RateLimit = rateLimit
+	s.RateBurst = rateBurst
+	s.AllowedOrigins = allowedOrigins
+}
+
+// RateLimit and the burst that goes with it
+func (s *Server) rateSettings() (float64, int) {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	if s.RateBurst > 0 {
+		return s.RateLimit, s.RateBurst
+	}
+	// a burst below 1 would reject every request
+	return s.RateLimit, max(1, int(math.Ceil(s.RateLimit)))
+}
+
+// the credentials the server is configured to accept and the
+// WWW-Authenticate challenges to send when a request has none of them
+func (s *Server) authenticators() ([]authenticator, []string) {
+	var auths []authenticator
+	var challenges []string
+	if s.BasicAuthUser != "" && s.BasicAuthPassword != "" {
+		auths = append(auths, basicAuth(s.BasicAuthUser, s.BasicAuthPassword))
+		challenges = append(challenges, `Basic realm="users", charset="UTF-8"`)
+	}
+	if len(s.APIKeys) > 0 {
+		auths = append(auths, apiKeyAuth(s.APIKeys))
+	}
+	if len(s.JWTSecret) > 0 {
+		auths = append(auths, jwtAuth(s.JWTSecret))
+		challenges = append(challenges, `Bearer realm="users"`)
+	}
+	return auths, challenges
+}
+
+func (s *Server) allowedOrigins() []string {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	if s.AllowedOrigins == nil {
+		return []string{"*"}
+	}
+	return s.AllowedOrigins
+}
+
+// config durations treat zero (or less) as "not set"
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	// also registers the "sqlite" driver, pure Go so no cgo needed
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	name       TEXT NOT NULL,
+	email      TEXT NOT NULL DEFAULT '',
+	version    INTEGER NOT NULL DEFAULT 1,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	-- NULL unless the user is soft deleted
+	deleted_at TEXT
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_name ON users (name);
+-- rows from before emails existed all have '' so leave those out
+CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users (email) WHERE email != ''`
+
+// selected in this order by every query that goes through scanUser
+const userColumns = `id, name, email, version, created_at, updated_at, deleted_at`
+
+// SQLiteStore keeps users in a SQLite database so they survive restarts.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (or creates) the database at path and makes sure
+// the users table exists.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows one writer at a time, a single connection
+	// queues requests up here instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	// databases created before the email, version and deleted_at fields existed need the
+	// columns added before the schema can index email
+	if err := addColumnIfMissing(db, "email", `TEXT NOT NULL DEFAULT ''`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "version", `INTEGER NOT NULL DEFAULT 1`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "deleted_at", `TEXT`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// brings an older users table up to date with sqliteSchema
+// does nothing on a fresh database, the schema creates the column itself
+func addColumnIfMissing(db *sql.DB, column, definition string) error {
+	var tables, n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return err
+	}
+
+	err = db.QueryRow(
+		`SELECT COUNT(*) FROM pragma_table_info('users') WHERE name = ?`,
+		column,
+	).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+// runs a trivial query, so a locked or unreadable database fails it too
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	var one int
+	return s.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one)
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Create(ctx context.Context, user User) (User, error) {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO users (name, email, version, created_at, updated_at) VALUES (?, ?, 1, ?, ?)`,
+		user.Name,
+		user.Email,
+		formatTime(now),
+		formatTime(now),
+	)
+	if err != nil {
+		return User{}, uniqueErr(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	user.ID = int(id)
+	user.Version = 1
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.DeletedAt = nil
+	return user, nil
+}
+
+func (s *SQLiteStore) CreateMany(ctx context.Context, users []User) ([]User, error) {
+	// one transaction, so a refused user rolls back the ones before it
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO users (name, email, version, created_at, updated_at) VALUES (?, ?, 1, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	created := make([]User, len(users))
+	for i, user := range users {
+		res, err := stmt.ExecContext(
+			ctx,
+			user.Name,
+			user.Email,
+			formatTime(now),
+			formatTime(now),
+		)
+		if err != nil {
+			return nil, &BatchError{Index: i, Err: uniqueErr(err)}
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+
+		user.ID = int(id)
+		user.Version = 1
+		user.CreatedAt = now
+		user.UpdatedAt = now
+		user.DeletedAt = nil
+		created[i] = user
+	}
+
+	return created, tx.Commit()
+}
+
+func (s *SQLiteStore) CheckCreate(ctx context.Context, user User) error {
+	// the same conditions as the unique indexes, soft deleted users included
+	var nameTaken, emailTaken bool
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM users WHERE name = ?), EXISTS (SELECT 1 FROM users WHERE email = ? AND email != '')`,
+		user.Name,
+		user.Email,
+	).Scan(&nameTaken, &emailTaken)
+	if err != nil {
+		return err
+	}
+	// Create would trip over the name index first
+	if nameTaken {
+		return ErrNameTaken
+	}
+	if emailTaken {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, id int) (User, error) {
+	user, err := scanUser(s.db.QueryRowContext(
+		ctx,
+		`SELECT `+userColumns+` FROM users WHERE id = ?`,
+		id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (s *SQLiteStore) GetMany(ctx context.Context, ids []int) ([]User, error) {
+	if len(ids) == 0 {
+		return []User{}, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	found, err := s.queryUsers(
+		ctx,
+		`SELECT `+userColumns+` FROM users WHERE id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// IN gives no particular order, put them back in the order asked for
+	byID := make(map[int]User, len(found))
+	for _, user := range found {
+		byID[user.ID] = user
+	}
+	users := []User{}
+	for _, id := range ids {
+		if user, ok := byID[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (s *SQLiteStore) GetByName(ctx context.Context, name string) (User, error) {
+	user, err := scanUser(s.db.QueryRowContext(
+		ctx,
+		`SELECT `+userColumns+` FROM users WHERE name = ?`,
+		name,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (s *SQLiteStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	// the '' rows are left out of users_email, so they'd be a scan and many matches
+	if email == "" {
+		return User{}, ErrUserNotFound
+	}
+	user, err := scanUser(s.db.QueryRowContext(
+		ctx,
+		`SELECT `+userColumns+` FROM users WHERE email = ?`,
+		email,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (s *SQLiteStore) Update(ctx context.Context, id int, fn func(user *User) error) (User, error) {
+	// the read and the write share a transaction so nothing lands in between
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanUser(tx.QueryRowContext(
+		ctx,
+		`SELECT `+userColumns+` FROM users WHERE id = ? AND deleted_at IS NULL`,
+		id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	user := current
+	if err := fn(&user); err != nil {
+		return User{}, err
+	}
+	// the id, version and timestamps aren't fn's to change
+	user.ID = id
+	user.Version = current.Version + 1
+	user.CreatedAt = current.CreatedAt
+	user.UpdatedAt = time.Now().UTC()
+	user.DeletedAt = nil
+
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE users SET name = ?, email = ?, version = ?, updated_at = ? WHERE id = ?`,
+		user.Name,
+		user.Email,
+		user.Version,
+		formatTime(user.UpdatedAt),
+		id,
+	)
+	if err != nil {
+		return User{}, uniqueErr(err)
+	}
+
+	return user, tx.Commit()
+}
+
+func (s *SQLiteStore) SoftDelete(ctx context.Context, id int) (User, error) {
+	now := formatTime(time.Now())
+	user, err := scanUser(s.db.QueryRowContext(
+		ctx,
+		`UPDATE users SET version = version + 1, updated_at = ?1, deleted_at = ?1
+		WHERE id = ?2 AND deleted_at IS NULL RETURNING `+userColumns,
+		now,
+		id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *SQLiteStore) Restore(ctx context.Context, id int) (User, error) {
+	user, err := scanUser(s.db.QueryRowContext(
+		ctx,
+		`UPDATE users SET version = version + 1, updated_at = ?, deleted_at = NULL
+		WHERE id = ? AND deleted_at IS NOT NULL RETURNING `+userColumns,
+		formatTime(time.Now()),
+		id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		// either there's no such user or it isn't deleted, tell them apart
+		if _, err := s.Get(ctx, id); err != nil {
+			return User{}, err
+		}
+		return User{}, ErrNotDeleted
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, id int) error {
+	// a single statement, so checking RowsAffected is atomic with the delete
+	res, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) DeleteAll(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users`); err != nil {
+		return err
+	}
+	// AUTOINCREMENT remembers the highest id here, clearing it restarts ids at 1
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sqlite_sequence WHERE name = 'users'`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// a WHERE condition leaving soft deleted users out unless withDeleted
+func deletedFilter(withDeleted bool) string {
+	if withDeleted {
+		return `TRUE`
+	}
+	return `deleted_at IS NULL`
+}
+
+func (s *SQLiteStore) List(ctx context.Context, limit, offset int, withDeleted bool) ([]User, error) {
+	return s.queryUsers(
+		ctx,
+		`SELECT `+userColumns+` FROM users WHERE `+deletedFilter(withDeleted)+` ORDER BY id LIMIT ? OFFSET ?`,
+		limit,
+		offset,
+	)
+}
+
+func (s *SQLiteStore) ListAfter(ctx context.Context, after, limit int, withDeleted bool) ([]User, error) {
+	return s.queryUsers(
+		ctx,
+		`SELECT `+userColumns+` FROM users WHERE id > ? AND `+deletedFilter(withDeleted)+` ORDER BY id LIMIT ?`,
+		after,
+		limit,
+	)
+}
+
+// instr rather than LIKE so % and _ in the query are matched literally
+// lower() only folds ASCII, close enough for names and emails
+// still a full table scan, neither index helps with a substring
+func (s *SQLiteStore) Search(ctx context.Context, query string, limit, offset int, withDeleted bool) ([]User, int, error) {
+	match := `(instr(lower(name), lower(?1)) > 0 OR instr(lower(email), lower(?1)) > 0) AND ` + deletedFilter(withDeleted)
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE `+match, query).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	users, err := s.queryUsers(
+		ctx,
+		`SELECT `+userColumns+` FROM users WHERE `+match+` ORDER BY id LIMIT ?2 OFFSET ?3`,
+		query,
+		limit,
+		offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// runs a query selecting userColumns
+func (s *SQLiteStore) queryUsers(ctx context.Context, query string, args ...any) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *SQLiteStore) Count(ctx context.Context, withDeleted bool) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE `+deletedFilter(withDeleted)).Scan(&n)
+	return n, err
+}
+
+func (s *SQLiteStore) Snapshot() (Snapshot, error) {
+	// one transaction so the users and the counter are from the same moment
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer tx.Rollback()
+
+	var snap Snapshot
+	// there's no row until the first insert
+	err = tx.QueryRow(`SELECT seq FROM sqlite_sequence WHERE name = 'users'`).Scan(&snap.LastID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Snapshot{}, err
+	}
+
+	rows, err := tx.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer rows.Close()
+
+	snap.Users = []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		snap.Users = append(snap.Users, user)
+	}
+	return snap, rows.Err()
+}
+
+func (s *SQLiteStore) LoadSnapshot(snap Snapshot) error {
+	if err := snap.check(); err != nil {
+		return err
+	}
+
+	// the old rows only go once every new one is in
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM users`); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO users (` + userColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, user := range snap.Users {
+		var deletedAt sql.NullString
+		if user.DeletedAt != nil {
+			deletedAt = sql.NullString{String: formatTime(*user.DeletedAt), Valid: true}
+		}
+		_, err := stmt.Exec(
+			user.ID,
+			user.Name,
+			user.Email,
+			user.Version,
+			formatTime(user.CreatedAt),
+			formatTime(user.UpdatedAt),
+			deletedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the inserts moved the counter up to the highest id, but LastID
+	// can be higher still if the newest users were deleted
+	if _, err := tx.Exec(`DELETE FROM sqlite_sequence WHERE name = 'users'`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('users', ?)`, snap.LastID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// turns a unique index violation into ErrNameTaken or ErrEmailTaken
+func uniqueErr(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Code() != sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return err
+	}
+	// the message names the column, e.g. "UNIQUE constraint failed: users.email"
+	if strings.Contains(sqliteErr.Error(), "users.email") {
+		return ErrEmailTaken
+	}
+	return ErrNameTaken
+}
+
+// satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// reads a row selected with userColumns
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var createdAt, updatedAt string
+	var deletedAt sql.NullString
+	if err := row.Scan(&user.ID, &user.Name, &user.Email, &user.Version, &createdAt, &updatedAt, &deletedAt); err != nil {
+		return User{}, err
+	}
+
+	var err error
+	if user.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return User{}, err
+	}
+	if user.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+		return User{}, err
+	}
+	if deletedAt.Valid {
+		t, err := time.Parse(time.RFC3339Nano, deletedAt.String)
+		if err != nil {
+			return User{}, err
+		}
+		user.DeletedAt = &t
+	}
+	return user, nil
+}
+
+// timestamps are stored as RFC 3339 text so they stay readable in the sqlite shell
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// how busy a Server is, for capacity planning. connections are only
+// counted when it serves through HTTPServer, which hooks up connState
+type serverStats struct {
+	// requests being handled right now, event streams included
+	inFlight atomic.Int64
+	// connections open right now and ever accepted
+	openConns  atomic.Int64
+	totalConns atomic.Int64
+
+	// requests handled, in all and by status/100, for /debug/vars
+	requests        atomic.Int64
+	requestsByClass [6]atomic.Int64
+}
+
+// counts a finished request that was answered with status
+func (st *serverStats) countRequest(status int) {
+	st.requests.Add(1)
+	if class := status / 100; class >= 1 && class < len(st.requestsByClass) {
+		st.requestsByClass[class].Add(1)
+	}
+}
+
+// the http.Server's ConnState callback
+func (st *serverStats) connState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		st.totalConns.Add(1)
+		st.openConns.Add(1)
+	// a hijacked connection is the handler's from then on, net/http never
+	// reports it closed
+	case http.StateClosed, http.StateHijacked:
+		st.openConns.Add(-1)
+	}
+}
+
+// the stats as /metrics series, read when it's scraped
+func (st *serverStats) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "http_requests_in_flight",
+				Help: "HTTP requests being handled right now, open event streams included.",
+			},
+			func() float64 { return float64(st.inFlight.Load()) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "http_connections_open",
+				Help: "Client connections open right now.",
+			},
+			func() float64 { return float64(st.openConns.Load()) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "http_connections_total",
+				Help: "Client connections accepted since the server started.",
+			},
+			func() float64 { return float64(st.totalConns.Load()) },
+		),
+	}
+}
+
+// counts the requests passing through it as in flight until they're done
+func inFlightMiddleware(st *serverStats) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			st.inFlight.Add(1)
+			defer st.inFlight.Add(-1)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,868 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// making the map
+type User struct {
+	// <user> rather than <User> for xml clients
+	XMLName xml.Name `json:"-" xml:"user"`
+
+	// validate has the rules every stored user has to meet, see Server.validateUser
+	ID    int    `json:"id" xml:"id"`
+	Name  string `json:"name" xml:"name" validate:"required,max=100"`
+	Email string `json:"email" xml:"email" validate:"required,email,max=254"`
+
+	// set by the store when the user is written, whatever the client sends
+	// Version starts at 1 and goes up by one on every update
+	Version   int       `json:"version" xml:"version"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+	// when the user was soft deleted, nil while it's live
+	// deleted users keep their name and email until they're purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+}
+
+// returned by stores when there's no user under the given id
+var ErrUserNotFound = errors.New("user not found")
+
+// returned by Create and Update when another user already has the value
+var (
+	ErrNameTaken  = errors.New("name is already taken")
+	ErrEmailTaken = errors.New("email is already taken")
+)
+
+// returned by Restore for a user that isn't soft deleted
+var ErrNotDeleted = errors.New("user is not deleted")
+
+// returned by Create and CreateMany when the store holds as many users as it may
+var ErrStoreFull = errors.New("store is full")
+
+// returned by writes that keep losing the race for a user to other writers
+var ErrWriteConflict = errors.New("user kept changing while saving, try again")
+
+// BatchError is returned by CreateMany when one user in the batch is refused.
+// Err is the reason, e.g. ErrNameTaken, and Index its position in the batch.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("user %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// UserStore is everything the handlers need from a storage backend.
+// Implementations must be safe for concurrent use.
+//
+// Any method can fail for reasons of the backend's own, a lost connection
+// say. Those errors are passed back as they are, while the errors below
+// (ErrUserNotFound, ErrNameTaken, ...) are the ones that say something
+// about the request, so callers can tell the two apart with errors.Is.
+//
+// ctx is the request's. Once it's done the store should stop what it's
+// doing and return ctx.Err(), the caller has nobody left to answer.
+type UserStore interface {
+	// saves a new user and returns it as stored, with its new id
+	// stores are responsible for stamping Version, CreatedAt and UpdatedAt
+	// and new users are never deleted, whatever DeletedAt is passed in
+	// names and emails are unique, see ErrNameTaken and ErrEmailTaken
+	Create(ctx context.Context, user User) (User, error)
+	// saves all of users or none of them, returning them as stored in the same order
+	// users also have to be unique among themselves, a refusal is a *BatchError
+	CreateMany(ctx context.Context, users []User) ([]User, error)
+	// the error Create would return for user right now, without creating it
+	// checked under the same locks as Create, but nothing stops another
+	// create taking the name once it returns
+	CheckCreate(ctx context.Context, user User) error
+	// ErrUserNotFound if there's no user with the id
+	Get(ctx context.Context, id int) (User, error)
+	// the users among ids that exist, in the order of ids, read at one moment
+	GetMany(ctx context.Context, ids []int) ([]User, error)
+	// names are unique so there's at most one match, ErrUserNotFound if there's none
+	GetByName(ctx context.Context, name string) (User, error)
+	// emails are unique as well, the same goes. "" never matches, users from
+	// before emails were required don't count as having one
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// runs fn against the stored user and saves the result atomically
+	// returns ErrUserNotFound if the id doesn't exist or is soft deleted,
+	// or fn's error untouched
+	// the same uniqueness rules as Create apply to the result
+	Update(ctx context.Context, id int, fn func(user *User) error) (User, error)
+	// sets DeletedAt, which hides the user without removing it
+	// returns ErrUserNotFound if the id doesn't exist or is deleted already
+	SoftDelete(ctx context.Context, id int) (User, error)
+	// clears DeletedAt again, ErrNotDeleted if it wasn't set
+	Restore(ctx context.Context, id int) (User, error)
+	// removes the user for good, soft deleted or not
+	// returns ErrUserNotFound if there was no user to remove
+	// the existence check and the removal must be atomic so that of two
+	// concurrent deletes of the same id exactly one succeeds
+	Delete(ctx context.Context, id int) error
+	// removes every user and starts ids from 1 again
+	DeleteAll(ctx context.Context) error
+	// Get, GetByName and GetByEmail return soft deleted users like any other, the
+	// methods below leave them out unless withDeleted is set
+
+	// returns users in ascending id order
+	List(ctx context.Context, limit, offset int, withDeleted bool) ([]User, error)
+	// returns up to limit users with ids above after, in ascending id order
+	ListAfter(ctx context.Context, after, limit int, withDeleted bool) ([]User, error)
+	// a page of the users whose name or email contains query, ignoring case,
+	// in ascending id order, along with how many match in total
+	Search(ctx context.Context, query string, limit, offset int, withDeleted bool) (users []User, total int, err error)
+	Count(ctx context.Context, withDeleted bool) (int, error)
+}
+
+// number of maps MemoryStore spreads users over, picked by id
+const memoryShards = 16
+
+// MemoryStore keeps users in memory, spread over shards by id so that
+// reading one user never waits on a write to a user in another shard.
+//
+// Names and emails are unique across all shards, so every write takes mu,
+// the lock for the indexes, and then the lock of the shard it changes.
+// Shards are only written with both held, which means either one is
+// enough to read them. Locks are only ever taken mu first, then shards in
+// ascending order, which is what keeps two operations from deadlocking.
+type MemoryStore struct {
+	// users expire this long after they were last written and are treated
+	// as gone from then on, zero keeps them forever. set it before use
+	// and run ExpireLoop to reclaim the memory
+	TTL time.Duration
+
+	// the most users kept at once, creating one more evicts whichever
+	// was least recently read or written. zero means no limit, set it before use
+	MaxEntries int
+
+	// compare names ignoring case, so "Bob" can't be created next to "bob"
+	// and GetByName("BOB") finds "Bob". names are still stored as given.
+	// set it before use, before loading a snapshot too
+	FoldNameCase bool
+
+	// the most users kept at once, creating one more fails with ErrStoreFull.
+	// soft deleted users count until they're purged, expired ones don't.
+	// zero means no limit, set it before use
+	MaxUsers int
+
+	// guards the indexes
+	mu sync.RWMutex
+
+	// map a name or email to the id of the user that has it, so the
+	// unique checks don't scan every user
+	nameIndex  map[string]int
+	emailIndex map[string]int
+
+	// how many users the shards hold and how many of those are soft
+	// deleted, expired ones included, so Count needn't scan. guarded by mu
+	userCount    int
+	deletedCount int
+
+	// last id handed out by Create
+	// only ever goes up so deleted ids are never reused. atomic so
+	// creates take their id before mu rather than while holding it
+	lastID atomic.Int64
+
+	shards [memoryShards]memoryShard
+
+	// ids from most to least recently used, only kept when MaxEntries is set
+	// Get only holds a shard's read lock but still has to move its user to
+	// the front, so these have a lock of their own, always taken last
+	lruMu    sync.Mutex
+	lru      *list.List
+	lruElems map[int]*list.Element
+}
+
+// the users whose id % memoryShards is the shard's position
+type memoryShard struct {
+	mu    sync.RWMutex
+	users map[int]User
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{}
+	s.resetLocked()
+	return s
+}
+
+// the shard a user with this id lives in, whether or not it exists
+func (s *MemoryStore) shard(id int) *memoryShard {
+	// clients can ask for negative ids too
+	i := id % memoryShards
+	if i < 0 {
+		i += memoryShards
+	}
+	return &s.shards[i]
+}
+
+// true once user has outlived TTL, expired users stay in their shard
+// until ExpireLoop gets to them but every method acts as if they're gone
+func (s *MemoryStore) expired(user User, now time.Time) bool {
+	return s.TTL > 0 && now.Sub(user.UpdatedAt) >= s.TTL
+}
+
+// looks a user up under mu, which is enough to read any shard
+func (s *MemoryStore) getLocked(id int, now time.Time) (User, bool) {
+	user, ok := s.shard(id).users[id]
+	if !ok || s.expired(user, now) {
+		return User{}, false
+	}
+	return user, true
+}
+
+// whether any of the n ids from first on belongs to a user already.
+// DeleteAll or a snapshot load between a create taking its ids and
+// getting mu puts lastID back, so they can clash. callers must hold mu
+func (s *MemoryStore) idsTakenLocked(first, n int) bool {
+	for id := first; id < first+n; id++ {
+		if _, ok := s.shard(id).users[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// empties the store and starts ids from 1 again
+// callers must hold mu and every shard's lock, or be the only one with s
+func (s *MemoryStore) resetLocked() {
+	s.nameIndex = make(map[string]int)
+	s.emailIndex = make(map[string]int)
+	s.lastID.Store(0)
+	s.userCount, s.deletedCount = 0, 0
+	for i := range s.shards {
+		s.shards[i].users = make(map[int]User)
+	}
+	s.lruMu.Lock()
+	s.lru = list.New()
+	s.lruElems = make(map[int]*list.Element)
+	s.lruMu.Unlock()
+}
+
+// lock every shard, always in ascending order
+func (s *MemoryStore) lockShards() {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+	}
+}
+
+func (s *MemoryStore) unlockShards() {
+	for i := range s.shards {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+func (s *MemoryStore) rlockShards() {
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+	}
+}
+
+func (s *MemoryStore) runlockShards() {
+	for i := range s.shards {
+		s.shards[i].mu.RUnlock()
+	}
+}
+
+func (s *MemoryStore) Create(ctx context.Context, user User) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	// a create that fails below still uses up its id, which
+	// leaves a gap just like a purge does
+	id := int(s.lastID.Add(1))
+	now := time.Now().UTC()
+
+	// the uniqueness checks and the insert share mu so two
+	// creates with the same name can't both pass
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUniqueLocked(user, 0, now); err != nil {
+		return User{}, err
+	}
+	if s.MaxUsers > 0 && s.roomLocked(now) <= 0 {
+		return User{}, ErrStoreFull
+	}
+	for s.idsTakenLocked(id, 1) {
+		id = int(s.lastID.Add(1))
+	}
+
+	user.ID = id
+	user.Version = 1
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.DeletedAt = nil
+	s.putLocked(user)
+	s.evictLocked()
+	return user, nil
+}
+
+func (s *MemoryStore) CreateMany(ctx context.Context, users []User) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the whole batch takes its ids in one go so they're consecutive
+	first := int(s.lastID.Add(int64(len(users)))) - len(users) + 1
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// check everything before inserting anything, so a refusal leaves no trace
+	names := make(map[string]bool, len(users))
+	emails := make(map[string]bool, len(users))
+	for i, user := range users {
+		if err := s.checkUniqueLocked(user, 0, now); err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		// and against the users earlier in the batch
+		if names[s.nameKey(user.Name)] {
+			return nil, &BatchError{Index: i, Err: ErrNameTaken}
+		}
+		if user.Email != "" && emails[user.Email] {
+			return nil, &BatchError{Index: i, Err: ErrEmailTaken}
+		}
+		names[s.nameKey(user.Name)] = true
+		emails[user.Email] = true
+	}
+	// the first user that doesn't fit is the one refused
+	if room := s.roomLocked(now); s.MaxUsers > 0 && len(users) > room {
+		return nil, &BatchError{Index: max(room, 0), Err: ErrStoreFull}
+	}
+	for s.idsTakenLocked(first, len(users)) {
+		first = int(s.lastID.Add(int64(len(users)))) - len(users) + 1
+	}
+
+	created := make([]User, len(users))
+	for i, user := range users {
+		user.ID = first + i
+		user.Version = 1
+		user.CreatedAt = now
+		user.UpdatedAt = now
+		user.DeletedAt = nil
+		s.putLocked(user)
+		created[i] = user
+	}
+	s.evictLocked()
+	return created, nil
+}
+
+func (s *MemoryStore) CheckCreate(ctx context.Context, user User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UTC()
+	if err := s.checkUniqueLocked(user, 0, now); err != nil {
+		return err
+	}
+	if s.MaxUsers > 0 && s.roomLocked(now) <= 0 {
+		return ErrStoreFull
+	}
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id int) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	// only this user's shard, the indexes don't come into it
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	user, ok := sh.users[id]
+	if !ok || s.expired(user, time.Now()) {
+		return User{}, ErrUserNotFound
+	}
+	s.bump(id)
+	return user, nil
+}
+
+func (s *MemoryStore) GetMany(ctx context.Context, ids []int) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// every shard at once, so the users are one consistent view
+	s.rlockShards()
+	defer s.runlockShards()
+
+	now := time.Now()
+	users := []User{}
+	for _, id := range ids {
+		user, ok := s.shard(id).users[id]
+		if !ok || s.expired(user, now) {
+			continue
+		}
+		s.bump(id)
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// emailIndex changes under mu along with the users themselves,
+	// so it can't point at a user that's gone
+	id, ok := s.emailIndex[email]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	user, ok := s.getLocked(id, time.Now())
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	s.bump(id)
+	return user, nil
+}
+
+func (s *MemoryStore) GetByName(ctx context.Context, name string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.nameIndex[s.nameKey(name)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	user, ok := s.getLocked(id, time.Now())
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	s.bump(id)
+	return user, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, id int, fn func(user *User) error) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	// read, modify and write back under mu
+	// so a concurrent delete can't slip in between
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	current, ok := s.getLocked(id, now)
+	if !ok || current.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	user := current
+	if err := fn(&user); err != nil {
+		return User{}, err
+	}
+	// id itself is left out, so keeping the name or email isn't a clash
+	if err := s.checkUniqueLocked(user, id, now); err != nil {
+		return User{}, err
+	}
+	// the id, version and timestamps aren't fn's to change
+	user.ID = id
+	user.Version = current.Version + 1
+	user.CreatedAt = current.CreatedAt
+	user.UpdatedAt = now
+	user.DeletedAt = nil
+	// a rename frees the old name only once the new one is known to be
+	// free, all under the one hold of mu
+	s.unindexLocked(current)
+	s.putLocked(user)
+	return user, nil
+}
+
+func (s *MemoryStore) SoftDelete(ctx context.Context, id int) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	user, ok := s.getLocked(id, now)
+	if !ok || user.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	// the name and email stay indexed, so nobody can take them in the meantime
+	user.Version++
+	user.UpdatedAt = now
+	user.DeletedAt = &now
+	s.putLocked(user)
+	return user, nil
+}
+
+func (s *MemoryStore) Restore(ctx context.Context, id int) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	user, ok := s.getLocked(id, now)
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if user.DeletedAt == nil {
+		return User{}, ErrNotDeleted
+	}
+	user.Version++
+	user.UpdatedAt = now
+	user.DeletedAt = nil
+	s.putLocked(user)
+	return user, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// check and delete under the same lock, checking first under a
+	// separate one would let two deletes both see the user
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.shard(id).users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	s.removeLocked(user)
+	// an expired user was already gone as far as callers are concerned
+	if s.expired(user, time.Now()) {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteAll(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockShards()
+	defer s.unlockShards()
+
+	s.resetLocked()
+	return nil
+}
+
+// removes every expired user, returning how many there were
+func (s *MemoryStore) DeleteExpired() int {
+	if s.TTL <= 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for i := range s.shards {
+		for _, user := range s.shards[i].users {
+			if s.expired(user, now) {
+				s.removeLocked(user)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// calls DeleteExpired every interval until ctx is done
+func (s *MemoryStore) ExpireLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := s.DeleteExpired(); n > 0 {
+				slog.Info("expired users", "count", n)
+			}
+		}
+	}
+}
+
+// writes user to its shard and the indexes and makes it the most
+// recently used. callers must hold mu
+func (s *MemoryStore) putLocked(user User) {
+	sh := s.shard(user.ID)
+	sh.mu.Lock()
+	old, existed := sh.users[user.ID]
+	sh.users[user.ID] = user
+	sh.mu.Unlock()
+	if existed {
+		s.countLocked(old, -1)
+	}
+	s.countLocked(user, 1)
+	s.indexLocked(user)
+
+	if s.MaxEntries > 0 {
+		s.lruMu.Lock()
+		if e, ok := s.lruElems[user.ID]; ok {
+			s.lru.MoveToFront(e)
+		} else {
+			s.lruElems[user.ID] = s.lru.PushFront(user.ID)
+		}
+		s.lruMu.Unlock()
+	}
+}
+
+// takes user out of its shard and the indexes. callers must hold mu
+func (s *MemoryStore) removeLocked(user User) {
+	sh := s.shard(user.ID)
+	sh.mu.Lock()
+	old, existed := sh.users[user.ID]
+	delete(sh.users, user.ID)
+	sh.mu.Unlock()
+	if existed {
+		s.countLocked(old, -1)
+	}
+	s.unindexLocked(user)
+
+	s.lruMu.Lock()
+	if e, ok := s.lruElems[user.ID]; ok {
+		s.lru.Remove(e)
+		delete(s.lruElems, user.ID)
+	}
+	s.lruMu.Unlock()
+}
+
+// how many more users fit under MaxUsers. soft deleted users take up room
+// until they're purged, but expired ones only look like they do until
+// DeleteExpired gets to them, so they aren't counted. callers must hold mu
+func (s *MemoryStore) roomLocked(now time.Time) int {
+	n := s.userCount
+	// only worth a scan when the store looks full
+	if s.TTL > 0 && n >= s.MaxUsers {
+		n = 0
+		for i := range s.shards {
+			for _, user := range s.shards[i].users {
+				if !s.expired(user, now) {
+					n++
+				}
+			}
+		}
+	}
+	return s.MaxUsers - n
+}
+
+// adds user to userCount and deletedCount, or takes it off with by -1.
+// callers must hold mu
+func (s *MemoryStore) countLocked(user User, by int) {
+	s.userCount += by
+	if user.DeletedAt != nil {
+		s.deletedCount += by
+	}
+}
+
+// makes an id that was just read the most recently used
+// only moves ids already in the list, so a user deleted meanwhile isn't brought back
+func (s *MemoryStore) bump(id int) {
+	if s.MaxEntries <= 0 {
+		return
+	}
+	s.lruMu.Lock()
+	defer s.lruMu.Unlock()
+
+	if e, ok := s.lruElems[id]; ok {
+		s.lru.MoveToFront(e)
+	}
+}
+
+// drops least recently used users until at most MaxEntries are left
+// callers must hold mu
+func (s *MemoryStore) evictLocked() {
+	if s.MaxEntries <= 0 {
+		return
+	}
+	for {
+		s.lruMu.Lock()
+		if s.lru.Len() <= s.MaxEntries {
+			s.lruMu.Unlock()
+			return
+		}
+		id := s.lru.Back().Value.(int)
+		s.lruMu.Unlock()
+
+		// a Get can move it up in between, so this is only nearly the least
+		// recently used. nothing can remove it though, that needs mu
+		s.removeLocked(s.shard(id).users[id])
+	}
+}
+
+// what nameIndex has name under
+func (s *MemoryStore) nameKey(name string) string {
+	if s.FoldNameCase {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// callers must hold mu
+func (s *MemoryStore) indexLocked(user User) {
+	s.nameIndex[s.nameKey(user.Name)] = user.ID
+	// users from before emails were required have none, like sqlite's
+	// index those don't count as taken
+	if user.Email != "" {
+		s.emailIndex[user.Email] = user.ID
+	}
+}
+
+// callers must hold mu
+func (s *MemoryStore) unindexLocked(user User) {
+	// an expired user's name may have been taken by someone new since
+	if key := s.nameKey(user.Name); s.nameIndex[key] == user.ID {
+		delete(s.nameIndex, key)
+	}
+	if s.emailIndex[user.Email] == user.ID {
+		delete(s.emailIndex, user.Email)
+	}
+}
+
+// returns an error if a user other than self already has user's name or email
+// self is 0 on create. callers must hold mu
+func (s *MemoryStore) checkUniqueLocked(user User, self int, now time.Time) error {
+	if id, taken := s.nameIndex[s.nameKey(user.Name)]; taken && id != self {
+		if _, live := s.getLocked(id, now); live {
+			return ErrNameTaken
+		}
+	}
+	if id, taken := s.emailIndex[user.Email]; taken && id != self {
+		if _, live := s.getLocked(id, now); live {
+			return ErrEmailTaken
+		}
+	}
+	return nil
+}
+
+// the ids of every unexpired user above after, sorted
+// soft deleted ones are only included with withDeleted
+// callers must hold every shard's read lock
+func (s *MemoryStore) sortedIDsLocked(after int, withDeleted bool) []int {
+	now := time.Now()
+	var ids []int
+	for i := range s.shards {
+		for id, user := range s.shards[i].users {
+			if id > after && !s.expired(user, now) && (withDeleted || user.DeletedAt == nil) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (s *MemoryStore) List(ctx context.Context, limit, offset int, withDeleted bool) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// every shard at once, so the page is one consistent view
+	s.rlockShards()
+	defer s.runlockShards()
+
+	// map iteration order is random, so sort the ids to keep pages stable
+	ids := s.sortedIDsLocked(0, withDeleted)
+
+	users := []User{}
+	for i := offset; i < len(ids) && len(users) < limit; i++ {
+		users = append(users, s.shard(ids[i]).users[ids[i]])
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) ListAfter(ctx context.Context, after, limit int, withDeleted bool) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.rlockShards()
+	defer s.runlockShards()
+
+	ids := s.sortedIDsLocked(after, withDeleted)
+
+	users := []User{}
+	for i := 0; i < len(ids) && len(users) < limit; i++ {
+		users = append(users, s.shard(ids[i]).users[ids[i]])
+	}
+	return users, nil
+}
+
+// a linear scan over every user, fine for what fits in memory
+// the sqlite store is the one to use once that gets slow
+func (s *MemoryStore) Search(ctx context.Context, query string, limit, offset int, withDeleted bool) ([]User, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	s.rlockShards()
+	defer s.runlockShards()
+
+	query = strings.ToLower(query)
+	users := []User{}
+	total := 0
+	for _, id := range s.sortedIDsLocked(0, withDeleted) {
+		user := s.shard(id).users[id]
+		if !strings.Contains(strings.ToLower(user.Name), query) &&
+			!strings.Contains(strings.ToLower(user.Email), query) {
+			continue
+		}
+		// keep counting past the page so the caller gets the full total
+		if total >= offset && len(users) < limit {
+			users = append(users, user)
+		}
+		total++
+	}
+	return users, total, nil
+}
+
+func (s *MemoryStore) Count(ctx context.Context, withDeleted bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	// nothing expires, so the counters are exact
+	if s.TTL <= 0 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if withDeleted {
+			return s.userCount, nil
+		}
+		return s.userCount - s.deletedCount, nil
+	}
+
+	s.rlockShards()
+	defer s.runlockShards()
+
+	now := time.Now()
+	n := 0
+	for i := range s.shards {
+		for _, user := range s.shards[i].users {
+			if !s.expired(user, now) && (withDeleted || user.DeletedAt == nil) {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// every UserStore, each test gets a fresh one. redis runs against
+// miniredis in the test process, so there's no server to set up
+var testStores = []struct {
+	name string
+	open func(t *testing.T) UserStore
+}{
+	{"memory", func(t *testing.T) UserStore {
+		return NewMemoryStore()
+	}},
+	{"sqlite", func(t *testing.T) UserStore {
+		store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatalf("open sqlite: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}},
+	{"redis", func(t *testing.T) UserStore {
+		store, err := NewRedisStore(miniredis.RunT(t).Addr())
+		if err != nil {
+			t.Fatalf("connect to miniredis: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}},
+}
+
+// runs test against each of testStores
+func forEachStore(t *testing.T, test func(t *testing.T, store UserStore)) {
+	for _, ts := range testStores {
+		t.Run(ts.name, func(t *testing.T) {
+			test(t, ts.open(t))
+		})
+	}
+}
+
+// creates a user named name with an email to match, failing the test on error
+func mustCreate(t *testing.T, store UserStore, name string) User {
+	t.Helper()
+	user, err := store.Create(context.Background(), User{Name: name, Email: name + "@example.com"})
+	if err != nil {
+		t.Fatalf("create %q: %v", name, err)
+	}
+	return user
+}
+
+func TestStoreCreateAndGet(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		bob := mustCreate(t, store, "bob")
+		alice := mustCreate(t, store, "alice")
+		if bob.ID != 1 || alice.ID != 2 {
+			t.Errorf("ids = %d, %d, want 1, 2", bob.ID, alice.ID)
+		}
+		if bob.Version != 1 || bob.CreatedAt.IsZero() || bob.DeletedAt != nil {
+			t.Errorf("created user = %+v, want version 1, a creation time and not deleted", bob)
+		}
+
+		got, err := store.Get(ctx, bob.ID)
+		if err != nil {
+			t.Fatalf("get %d: %v", bob.ID, err)
+		}
+		if got.Name != "bob" || got.Email != "bob@example.com" {
+			t.Errorf("get %d = %+v, want bob", bob.ID, got)
+		}
+		if _, err := store.Get(ctx, 99); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("get 99 = %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestStoreCreateRejectsTakenNameAndEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		mustCreate(t, store, "bob")
+
+		_, err := store.Create(ctx, User{Name: "bob", Email: "other@example.com"})
+		if !errors.Is(err, ErrNameTaken) {
+			t.Errorf("create with a taken name = %v, want ErrNameTaken", err)
+		}
+		_, err = store.Create(ctx, User{Name: "other", Email: "bob@example.com"})
+		if !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("create with a taken email = %v, want ErrEmailTaken", err)
+		}
+	})
+}
+
+func TestStoreDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		for i := 1; i <= 3; i++ {
+			mustCreate(t, store, fmt.Sprintf("user%d", i))
+		}
+
+		if err := store.Delete(ctx, 2); err != nil {
+			t.Fatalf("delete 2: %v", err)
+		}
+		if _, err := store.Get(ctx, 2); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("get after delete = %v, want ErrUserNotFound", err)
+		}
+		if err := store.Delete(ctx, 2); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("second delete = %v, want ErrUserNotFound", err)
+		}
+
+		// ids aren't handed out again, a count of users would give 3 and
+		// overwrite user3
+		if next := mustCreate(t, store, "user4"); next.ID != 4 {
+			t.Errorf("id after deleting 2 of 3 = %d, want 4", next.ID)
+		}
+		for _, id := range []int{1, 3} {
+			name := fmt.Sprintf("user%d", id)
+			got, err := store.Get(ctx, id)
+			if err != nil {
+				t.Fatalf("get %d: %v", id, err)
+			}
+			if got.Name != name || got.Email != name+"@example.com" {
+				t.Errorf("get %d = %+v, want %s unchanged", id, got, name)
+			}
+		}
+	})
+}
+
+func TestStoreDeleteFreesEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		bob := mustCreate(t, store, "bob")
+		if got, err := store.GetByEmail(ctx, "bob@example.com"); err != nil || got.ID != bob.ID {
+			t.Fatalf("get by email = %+v, %v, want bob", got, err)
+		}
+
+		if err := store.Delete(ctx, bob.ID); err != nil {
+			t.Fatalf("delete %d: %v", bob.ID, err)
+		}
+		if _, err := store.GetByEmail(ctx, "bob@example.com"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("get by email after delete = %v, want ErrUserNotFound", err)
+		}
+		// nothing's left in the index to make it look taken
+		if _, err := store.Create(ctx, User{Name: "robert", Email: "bob@example.com"}); err != nil {
+			t.Errorf("create with a deleted user's email: %v", err)
+		}
+	})
+}
+
+func TestStoreRename(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		bob := mustCreate(t, store, "bob")
+		mustCreate(t, store, "alice")
+		rename := func(name, email string) error {
+			_, err := store.Update(ctx, bob.ID, func(user *User) error {
+				user.Name, user.Email = name, email
+				return nil
+			})
+			return err
+		}
+
+		// keeping its own name and email isn't a clash with itself
+		if err := rename("bob", "bob@example.com"); err != nil {
+			t.Errorf("rename to its own name: %v", err)
+		}
+		if err := rename("alice", "bob@example.com"); !errors.Is(err, ErrNameTaken) {
+			t.Errorf("rename onto alice's name = %v, want ErrNameTaken", err)
+		}
+		if err := rename("bob", "alice@example.com"); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("rename onto alice's email = %v, want ErrEmailTaken", err)
+		}
+
+		if err := rename("robert", "robert@example.com"); err != nil {
+			t.Fatalf("rename to robert: %v", err)
+		}
+		if got, err := store.GetByName(ctx, "robert"); err != nil || got.ID != bob.ID {
+			t.Errorf("get by new name = %+v, %v, want bob's id", got, err)
+		}
+		// the old name and email are free again
+		mustCreate(t, store, "bob")
+	})
+}
+
+func TestMemoryStoreCaseOnlyRename(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.FoldNameCase = true
+	bob := mustCreate(t, store, "bob")
+
+	// the same name ignoring case, which is bob's own
+	if _, err := store.Update(ctx, bob.ID, func(user *User) error {
+		user.Name = "Bob"
+		return nil
+	}); err != nil {
+		t.Fatalf("rename bob to Bob: %v", err)
+	}
+	got, err := store.GetByName(ctx, "BOB")
+	if err != nil || got.Name != "Bob" {
+		t.Errorf("get by name BOB = %+v, %v, want Bob", got, err)
+	}
+	if _, err := store.Create(ctx, User{Name: "bob", Email: "other@example.com"}); !errors.Is(err, ErrNameTaken) {
+		t.Errorf("create bob next to Bob = %v, want ErrNameTaken", err)
+	}
+}
+
+func TestRedisStoreGivesUpOnBusyUser(t *testing.T) {
+	store, err := NewRedisStore(miniredis.RunT(t).Addr())
+	if err != nil {
+		t.Fatalf("connect to miniredis: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	bob := mustCreate(t, store, "bob")
+	// another writer saves bob between every read and save of the update
+	busy := func(ctx context.Context, attempts *int) error {
+		_, err := store.Update(ctx, bob.ID, func(user *User) error {
+			*attempts++
+			_, err := store.Update(context.Background(), bob.ID, func(user *User) error { return nil })
+			return err
+		})
+		return err
+	}
+
+	attempts := 0
+	if err := busy(context.Background(), &attempts); !errors.Is(err, ErrWriteConflict) {
+		t.Errorf("update of a busy user = %v, want ErrWriteConflict", err)
+	}
+	if attempts != redisMaxAttempts {
+		t.Errorf("attempts = %d, want %d", attempts, redisMaxAttempts)
+	}
+
+	// a cancelled request stops retrying straight away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	if err := busy(ctx, &attempts); !errors.Is(err, context.Canceled) || attempts != 0 {
+		t.Errorf("update with a cancelled ctx = %v after %d attempts, want context.Canceled after 0", err, attempts)
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		for i := 1; i <= 5; i++ {
+			mustCreate(t, store, fmt.Sprintf("user%d", i))
+		}
+		if _, err := store.SoftDelete(ctx, 2); err != nil {
+			t.Fatalf("soft delete 2: %v", err)
+		}
+
+		users, err := store.List(ctx, 2, 1, false)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if ids := userIDs(users); fmt.Sprint(ids) != "[3 4]" {
+			t.Errorf("list limit 2 offset 1 = %v, want [3 4]", ids)
+		}
+		users, err = store.List(ctx, 10, 0, true)
+		if err != nil {
+			t.Fatalf("list with deleted: %v", err)
+		}
+		if ids := userIDs(users); fmt.Sprint(ids) != "[1 2 3 4 5]" {
+			t.Errorf("list with deleted = %v, want [1 2 3 4 5]", ids)
+		}
+
+		live, err := store.Count(ctx, false)
+		if err != nil {
+			t.Fatalf("count: %v", err)
+		}
+		all, err := store.Count(ctx, true)
+		if err != nil {
+			t.Fatalf("count with deleted: %v", err)
+		}
+		if live != 4 || all != 5 {
+			t.Errorf("counts = %d live, %d in all, want 4 and 5", live, all)
+		}
+	})
+}
+
+func TestStoreCountFollowsWrites(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		wantCounts := func(step string, live, all int) {
+			t.Helper()
+			gotLive, err := store.Count(ctx, false)
+			if err != nil {
+				t.Fatalf("count after %s: %v", step, err)
+			}
+			gotAll, err := store.Count(ctx, true)
+			if err != nil {
+				t.Fatalf("count with deleted after %s: %v", step, err)
+			}
+			if gotLive != live || gotAll != all {
+				t.Errorf("counts after %s = %d live, %d in all, want %d and %d", step, gotLive, gotAll, live, all)
+			}
+		}
+
+		for i := 1; i <= 3; i++ {
+			mustCreate(t, store, fmt.Sprintf("user%d", i))
+		}
+		wantCounts("creates", 3, 3)
+		if _, err := store.SoftDelete(ctx, 2); err != nil {
+			t.Fatalf("soft delete 2: %v", err)
+		}
+		wantCounts("soft delete", 2, 3)
+		if _, err := store.Restore(ctx, 2); err != nil {
+			t.Fatalf("restore 2: %v", err)
+		}
+		wantCounts("restore", 3, 3)
+		if _, err := store.Update(ctx, 1, func(user *User) error { return nil }); err != nil {
+			t.Fatalf("update 1: %v", err)
+		}
+		wantCounts("update", 3, 3)
+		if _, err := store.SoftDelete(ctx, 2); err != nil {
+			t.Fatalf("soft delete 2: %v", err)
+		}
+		if err := store.Delete(ctx, 2); err != nil {
+			t.Fatalf("purge 2: %v", err)
+		}
+		wantCounts("purging a soft deleted user", 2, 2)
+		if err := store.Delete(ctx, 1); err != nil {
+			t.Fatalf("purge 1: %v", err)
+		}
+		wantCounts("purge", 1, 1)
+		if err := store.DeleteAll(ctx); err != nil {
+			t.Fatalf("delete all: %v", err)
+		}
+		wantCounts("delete all", 0, 0)
+	})
+}
+
+// the ids of users, in order
+func userIDs(users []User) []int {
+	ids := make([]int, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	return ids
+}
+
+func TestMemoryStoreShards(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	// more users than shards, so every shard gets a few
+	const n = 3*memoryShards + 5
+	for i := 1; i <= n; i++ {
+		mustCreate(t, store, fmt.Sprintf("user%d", i))
+	}
+
+	users, err := store.List(ctx, n, 0, false)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	for i, user := range users {
+		if user.ID != i+1 {
+			t.Fatalf("list position %d has id %d, want ids in order across shards", i, user.ID)
+		}
+	}
+	if len(users) != n {
+		t.Errorf("list returned %d users, want %d", len(users), n)
+	}
+	for id := 1; id <= n; id++ {
+		if _, err := store.Get(ctx, id); err != nil {
+			t.Errorf("get %d: %v", id, err)
+		}
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.MaxEntries = 3
+	for _, name := range []string{"one", "two", "three"} {
+		mustCreate(t, store, name)
+	}
+	// reads and writes both count as a use, so three is the oldest now
+	if _, err := store.Get(ctx, 1); err != nil {
+		t.Fatalf("get 1: %v", err)
+	}
+	if _, err := store.Update(ctx, 2, func(user *User) error { return nil }); err != nil {
+		t.Fatalf("update 2: %v", err)
+	}
+
+	mustCreate(t, store, "four")
+	if _, err := store.Get(ctx, 3); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("get 3 after creating past the cap = %v, want it evicted", err)
+	}
+	mustCreate(t, store, "five")
+	if _, err := store.Get(ctx, 1); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("get 1 after creating past the cap = %v, want it evicted", err)
+	}
+
+	users, err := store.List(ctx, 10, 0, true)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if ids := userIDs(users); fmt.Sprint(ids) != "[2 4 5]" {
+		t.Errorf("users left = %v, want [2 4 5]", ids)
+	}
+	if n, err := store.Count(ctx, true); err != nil || n != 3 {
+		t.Errorf("count after evictions = %d, %v, want 3", n, err)
+	}
+	// an evicted user's name is free again
+	mustCreate(t, store, "three")
+}
+
+func TestMemoryStoreConcurrentCreates(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	const creators = 50
+	ids := make(chan int, creators)
+	var wg sync.WaitGroup
+	for i := range creators {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("user%d", i)
+			user, err := store.Create(ctx, User{Name: name, Email: name + "@example.com"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- user.ID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[int]bool{}
+	for id := range ids {
+		if seen[id] || id < 1 || id > creators {
+			t.Errorf("id %d handed out twice or out of 1 to %d", id, creators)
+		}
+		seen[id] = true
+	}
+	if len(seen) != creators {
+		t.Errorf("%d ids handed out, want %d", len(seen), creators)
+	}
+}
+
+func TestMemoryStoreRefusedCreateUsesID(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	mustCreate(t, store, "bob")
+	if _, err := store.Create(ctx, User{Name: "bob", Email: "other@example.com"}); !errors.Is(err, ErrNameTaken) {
+		t.Fatalf("create with a taken name = %v, want ErrNameTaken", err)
+	}
+	// the refused create took 2, like a purge would leave it
+	if alice := mustCreate(t, store, "alice"); alice.ID != 3 {
+		t.Errorf("id after a refused create = %d, want 3", alice.ID)
+	}
+
+	if err := store.DeleteAll(ctx); err != nil {
+		t.Fatalf("delete all: %v", err)
+	}
+	if carol := mustCreate(t, store, "carol"); carol.ID != 1 {
+		t.Errorf("id after delete all = %d, want 1", carol.ID)
+	}
+}
+
+// the part of a store BenchmarkReadsDuringWrites uses
+type getUpdater interface {
+	Get(ctx context.Context, id int) (User, error)
+	Update(ctx context.Context, id int, fn func(user *User) error) (User, error)
+}
+
+// the memory store as it was before it was sharded, one map behind one
+// lock, just enough of it to compare against
+type singleLockStore struct {
+	mu    sync.RWMutex
+	users map[int]User
+}
+
+func (s *singleLockStore) Get(ctx context.Context, id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *singleLockStore) Update(ctx context.Context, id int, fn func(user *User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if err := fn(&user); err != nil {
+		return User{}, err
+	}
+	user.Version++
+	s.users[id] = user
+	return user, nil
+}
+
+// one write for every nine reads, the reads are what sharding speeds up
+// since they only wait on writes to their own shard
+func BenchmarkReadsDuringWrites(b *testing.B) {
+	const users = 1000
+	stores := []struct {
+		name  string
+		store getUpdater
+	}{
+		{"sharded", NewMemoryStore()},
+		{"single-lock", &singleLockStore{users: map[int]User{}}},
+	}
+	for _, bs := range stores {
+		for id := 1; id <= users; id++ {
+			user := User{ID: id, Name: fmt.Sprintf("user%d", id), Email: fmt.Sprintf("user%d@example.com", id)}
+			switch store := bs.store.(type) {
+			case *MemoryStore:
+				if _, err := store.Create(context.Background(), user); err != nil {
+					b.Fatal(err)
+				}
+			case *singleLockStore:
+				store.users[id] = user
+			}
+		}
+
+		b.Run(bs.name, func(b *testing.B) {
+			ctx := context.Background()
+			var goroutines atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				// each goroutine starts somewhere else and counts on its own,
+				// a shared counter would be the bottleneck instead of the store
+				n := int(goroutines.Add(1)) * 97
+				for pb.Next() {
+					n++
+					id := n%users + 1
+					if n%10 == 0 {
+						bs.store.Update(ctx, id, func(user *User) error { return nil })
+					} else {
+						bs.store.Get(ctx, id)
+					}
+				}
+			})
+		})
+	}
+}
+
+// a memory store with users 1 to n, through UserStore like the server uses it
+func benchStore(b *testing.B, n int) UserStore {
+	b.Helper()
+	var store UserStore = NewMemoryStore()
+	for i := 1; i <= n; i++ {
+		user := User{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i)}
+		if _, err := store.Create(context.Background(), user); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return store
+}
+
+func BenchmarkCreate(b *testing.B) {
+	store := benchStore(b, 0)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := range b.N {
+		user := User{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i)}
+		if _, err := store.Create(ctx, user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the part of a store BenchmarkParallelCreate uses
+type creator interface {
+	Create(ctx context.Context, user User) (User, error)
+}
+
+// the memory store's creates as they were before ids came from an atomic
+// counter, the id is bumped under the same lock as the checks and the insert
+type lockedIDStore struct {
+	mu     sync.Mutex
+	lastID int
+	names  map[string]int
+	emails map[string]int
+	users  map[int]User
+}
+
+func (s *lockedIDStore) Create(ctx context.Context, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.names[user.Name]; ok {
+		return User{}, ErrNameTaken
+	}
+	if _, ok := s.emails[user.Email]; ok {
+		return User{}, ErrEmailTaken
+	}
+	s.lastID++
+	user.ID = s.lastID
+	user.Version = 1
+	user.CreatedAt = time.Now().UTC()
+	user.UpdatedAt = user.CreatedAt
+	s.names[user.Name] = user.ID
+	s.emails[user.Email] = user.ID
+	s.users[user.ID] = user
+	return user, nil
+}
+
+// creates from every goroutine at once, the memory store's ids come from an
+// atomic counter so only the uniqueness checks and the insert wait on each
+// other. locked-id is the baseline that takes its ids under the lock too
+func BenchmarkParallelCreate(b *testing.B) {
+	// a fresh store for each run, the names repeat between runs
+	stores := []struct {
+		name string
+		open func(b *testing.B) creator
+	}{
+		{"atomic-id", func(b *testing.B) creator { return benchStore(b, 0) }},
+		{"locked-id", func(b *testing.B) creator {
+			return &lockedIDStore{names: map[string]int{}, emails: map[string]int{}, users: map[int]User{}}
+		}},
+	}
+	for _, bs := range stores {
+		b.Run(bs.name, func(b *testing.B) {
+			store := bs.open(b)
+			ctx := context.Background()
+			var goroutines atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				g := goroutines.Add(1)
+				for n := 0; pb.Next(); n++ {
+					name := fmt.Sprintf("user%d-%d", g, n)
+					if _, err := store.Create(ctx, User{Name: name, Email: name + "@example.com"}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	const users = 1000
+	store := benchStore(b, users)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := range b.N {
+		if _, err := store.Get(ctx, i%users+1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	const users = 1000
+	store := benchStore(b, users)
+	ctx := context.Background()
+	var goroutines atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := int(goroutines.Add(1)) * 97
+		for pb.Next() {
+			n++
+			if _, err := store.Get(ctx, n%users+1); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// mostly reads like real traffic: of every twenty requests one creates a
+// user, one updates one and the rest are gets
+func BenchmarkMixed(b *testing.B) {
+	const users = 1000
+	store := benchStore(b, users)
+	ctx := context.Background()
+	var goroutines atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		g := int(goroutines.Add(1))
+		n := g * 97
+		for pb.Next() {
+			n++
+			switch id := n%users + 1; n % 20 {
+			case 0:
+				// the goroutine's number keeps names apart between goroutines
+				name := fmt.Sprintf("new%d-%d", g, n)
+				if _, err := store.Create(ctx, User{Name: name, Email: name + "@example.com"}); err != nil {
+					b.Error(err)
+					return
+				}
+			case 1:
+				if _, err := store.Update(ctx, id, func(user *User) error { return nil }); err != nil {
+					b.Error(err)
+					return
+				}
+			default:
+				if _, err := store.Get(ctx, id); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}
+	})
+}
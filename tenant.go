@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// picks whose users a request sees when Server.Tenants is set
+const tenantHeader = "X-Tenant-ID"
+
+// tenant names end up in logs and audit entries like request ids do
+const maxTenantLength = 64
+
+// the -max-tenants nothing else sets, a tenant's store holds little until
+// it's used but every new X-Tenant-ID a client makes up gets one
+const defaultMaxTenants = 1000
+
+// context key for the tenant, unexported so no other package can clash with it
+type tenantKey struct{}
+
+// context key for the tenant's store, withTenant looks it up once per request
+type tenantStoreKey struct{}
+
+// returned by tenantStores.get for a new tenant past Server.MaxTenants
+var errTooManyTenants = codedErrorf("tenant_limit_reached", "the server holds as many tenants as it may")
+
+// every tenant's store but the shared one, which is Server.Store
+// the zero value is ready to use
+type tenantStores struct {
+	// only guards the map and empty, each store does its own locking
+	mu     sync.Mutex
+	stores map[string]UserStore
+	// what reads of a tenant without a store yet see, so a GET with any
+	// X-Tenant-ID doesn't leave a store behind. nothing ever writes to it
+	empty UserStore
+}
+
+// the store for tenant, made with newStore the first time a write asks for
+// it. reads before then get an empty store that isn't kept. at most max
+// tenants get a store, zero means no limit
+func (t *tenantStores) get(tenant string, write bool, max int, newStore func(tenant string) UserStore) (UserStore, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if store, ok := t.stores[tenant]; ok {
+		return store, nil
+	}
+	if !write {
+		if t.empty == nil {
+			t.empty = NewMemoryStore()
+		}
+		return t.empty, nil
+	}
+	if max > 0 && len(t.stores) >= max {
+		return nil, errTooManyTenants
+	}
+	if t.stores == nil {
+		t.stores = make(map[string]UserStore)
+	}
+	store := newStore(tenant)
+	t.stores[tenant] = store
+	return store, nil
+}
+
+// every store made so far, for ExpireTenantsLoop
+func (t *tenantStores) all() []UserStore {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stores := make([]UserStore, 0, len(t.stores))
+	for _, store := range t.stores {
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+// the tenant tenantRoutes gave the request, "" for the shared one
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// where the handlers keep the users of the request's tenant
+func (s *Server) store(ctx context.Context) UserStore {
+	if store, ok := ctx.Value(tenantStoreKey{}).(UserStore); ok {
+		return store
+	}
+	return s.Store
+}
+
+// calls DeleteExpired on every tenant's store each interval until ctx is
+// done, one loop for all of them rather than one per tenant
+func (s *Server) ExpireTenantsLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n := 0
+			for _, store := range s.tenants.all() {
+				if expirer, ok := store.(interface{ DeleteExpired() int }); ok {
+					n += expirer.DeleteExpired()
+				}
+			}
+			if n > 0 {
+				s.logger().Info("expired tenants' users", "count", n)
+			}
+		}
+	}
+}
+
+// puts the X-Tenant-ID of every request to routes in its context, for
+// s.store and friends. without Tenants they're left as they are
+// only the routes that touch users get this, /healthz and the like
+// don't need a tenant even with RequireTenant
+func (s *Server) tenantRoutes(routes []apiRoute) []apiRoute {
+	if !s.Tenants {
+		return routes
+	}
+
+	wrapped := make([]apiRoute, len(routes))
+	for i, route := range routes {
+		wrapped[i] = apiRoute{route.pattern, s.withTenant(route.handler)}
+	}
+	return wrapped
+}
+
+func (s *Server) withTenant(next http.HandlerFunc) http.HandlerFunc {
+	if !s.Tenants {
+		return next
+	}
+
+	return func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		tenant := r.Header.Get(tenantHeader)
+		if tenant == "" && s.RequireTenant {
+			writeError(
+				w,
+				http.StatusBadRequest,
+				codedErrorf("tenant_required", "%s header is required", tenantHeader),
+			)
+			return
+		}
+		if tenant != "" && !validTenant(tenant) {
+			writeError(
+				w,
+				http.StatusBadRequest,
+				codedErrorf("invalid_tenant", "%s must be up to %d letters, digits, - or _", tenantHeader, maxTenantLength),
+			)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tenantKey{}, tenant)
+		if tenant != "" {
+			newStore := s.NewTenantStore
+			if newStore == nil {
+				newStore = func(string) UserStore { return NewMemoryStore() }
+			}
+			write := r.Method != http.MethodGet && r.Method != http.MethodHead
+			store, err := s.tenants.get(tenant, write, s.MaxTenants, newStore)
+			if err != nil {
+				writeError(
+					w,
+					http.StatusInsufficientStorage,
+					err,
+				)
+				return
+			}
+			ctx = context.WithValue(ctx, tenantStoreKey{}, store)
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func validTenant(tenant string) bool {
+	if len(tenant) > maxTenantLength {
+		return false
+	}
+	for i := 0; i < len(tenant); i++ {
+		c := tenant[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// how long the last spans get to go out on shutdown, on top of whatever
+// the http shutdown took
+const tracingShutdownTimeout = 5 * time.Second
+
+// makes the spans this package starts itself. it goes through the global
+// provider, so until setupTracing installs a real one every span is a no-op
+var tracer = otel.Tracer("GO-SERVER")
+
+// exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. the exporter reads the rest of
+// the standard OTEL_* variables (headers, timeouts, ...) by itself
+// the returned func flushes whatever spans are still buffered
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(
+		ctx,
+		resource.WithAttributes(attribute.String("service.name", "GO-SERVER")),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over the default above
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	// continue traces started by whoever called us
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return provider.Shutdown, nil
+}
+
+// makes every request a span named after the route it matched in routes,
+// e.g. "GET /users/{id}", so spans group the same way metrics do
+func tracingMiddleware(routes *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		tagRoute := http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			trace.SpanFromContext(r.Context()).SetAttributes(
+				attribute.String("http.route", routeLabel(routes, r)),
+			)
+			next.ServeHTTP(w, r)
+		})
+
+		return otelhttp.NewHandler(
+			tagRoute,
+			"http.server",
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return r.Method + " " + routeLabel(routes, r)
+			}),
+		)
+	}
+}
+
+// starts a span for a store call under the request's span
+// end it as soon as the call returns
+func storeSpan(ctx context.Context, op string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := tracer.Start(ctx, "store."+op, trace.WithAttributes(attrs...))
+	return span
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// checks the validate tags on User, safe to share between requests
+// fields are reported by their json name, so errors match what clients sent
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// what a failed tag means, to go after the field's name
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email"
+	case "max":
+		return fmt.Sprintf("must be at most %s characters", fe.Param())
+	case "min":
+		return fmt.Sprintf("must be at least %s characters", fe.Param())
+	}
+	return fmt.Sprintf("failed %s", fe.Tag())
+}
+
+// the code for a failed tag, e.g. name_required or email_invalid
+func fieldCode(fe validator.FieldError) string {
+	if fe.Tag() == "required" {
+		return fe.Field() + "_required"
+	}
+	return fe.Field() + "_invalid"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// what GET /version sends back
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+}
+
+// the build metadata, taking the commit from the vcs info Go embeds
+// by itself when -ldflags didn't set it
+func buildInfo() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range bi.Settings {
+		if setting.Key == "vcs.revision" && info.Commit == "unknown" {
+			info.Commit = setting.Value
+		}
+	}
+	return info
+}
+
+func handleVersion(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	writeJSON(w, r, http.StatusOK, buildInfo())
+}
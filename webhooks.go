@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// how long one delivery attempt may take, so a hung receiver can't stall the queue
+	webhookTimeout = 5 * time.Second
+	// tries per event before giving up, waiting webhookBackoff, then twice that, ...
+	webhookAttempts = 4
+	webhookBackoff  = 500 * time.Millisecond
+	// events waiting for one url, more than this and new ones are dropped
+	webhookQueueSize = 256
+)
+
+// body of every webhook POST, the event plus when it happened
+type webhookPayload struct {
+	userEvent
+	Time time.Time `json:"time"`
+}
+
+// POSTs user events to a set of urls in the background
+// each url has its own queue, so a slow one doesn't hold up the others
+// and every receiver sees events in the order they happened
+type webhookNotifier struct {
+	client  *http.Client
+	logger  *slog.Logger
+	targets []webhookTarget
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan []byte
+}
+
+func newWebhookNotifier(urls []string, logger *slog.Logger) *webhookNotifier {
+	n := &webhookNotifier{
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+	}
+	for _, url := range urls {
+		target := webhookTarget{
+			url:   url,
+			queue: make(chan []byte, webhookQueueSize),
+		}
+		n.targets = append(n.targets, target)
+		go n.deliverLoop(target)
+	}
+	return n
+}
+
+// queues ev for every url, never blocks the handler that made the change
+func (n *webhookNotifier) send(ev userEvent) {
+	if len(n.targets) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		userEvent: ev,
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		n.logger.Error("webhook payload failed", "err", err)
+		return
+	}
+
+	for _, target := range n.targets {
+		select {
+		case target.queue <- body:
+		default:
+			n.logger.Warn("webhook queue full, dropping event", "url", target.url, "type", ev.Type)
+		}
+	}
+}
+
+func (n *webhookNotifier) deliverLoop(target webhookTarget) {
+	for body := range target.queue {
+		n.deliver(target.url, body)
+	}
+}
+
+// POSTs body to url, retrying with backoff until it's accepted or we run out of attempts
+func (n *webhookNotifier) deliver(url string, body []byte) {
+	delay := webhookBackoff
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		var retry bool
+		if retry, err = n.post(url, body); err == nil || !retry {
+			break
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	if err != nil {
+		n.logger.Error("webhook delivery failed", "url", url, "attempts", webhookAttempts, "err", err)
+	}
+}
+
+// makes one delivery attempt, retry says whether another one could succeed
+func (n *webhookNotifier) post(url string, body []byte) (retry bool, err error) {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// connection refused, timed out and the like
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("receiver answered %s", resp.Status)
+	// the receiver is struggling, or asking us to slow down. any other
+	// 4xx means it doesn't want this event and asking again won't help
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}